@@ -669,18 +669,44 @@ func CollectUnused(desc *ast.Description, target *targets.Target, eh ast.ErrorHa
 		return nil, errors.New("typecheck failed")
 	}
 
-	nodes := comp.collectUnused()
+	nodes := comp.collectUnused(nil)
 	if comp.errors > 0 {
 		return nil, errors.New("collectUnused failed")
 	}
 	return nodes, nil
 }
 
-func (comp *compiler) collectUnused() []ast.Node {
+// CollectUnusedSubsets is CollectUnused for several subsets of calls: for each of the subsets it returns
+// the nodes that would be unused if only the calls the subset function returns true for were present.
+// The descriptions are type checked only once.
+func CollectUnusedSubsets(desc *ast.Description, target *targets.Target, eh ast.ErrorHandler,
+	subsets []func(*ast.Call) bool) ([][]ast.Node, error) {
+	comp := createCompiler(desc, target, eh)
+	comp.typecheck()
+	if comp.errors > 0 {
+		return nil, errors.New("typecheck failed")
+	}
+
+	var res [][]ast.Node
+	for _, calls := range subsets {
+		res = append(res, comp.collectUnused(calls))
+	}
+	if comp.errors > 0 {
+		return nil, errors.New("collectUnused failed")
+	}
+	return res, nil
+}
+
+// collectUnused returns unused nodes, if calls is not nil, only the calls it returns true for are considered.
+func (comp *compiler) collectUnused(calls func(*ast.Call) bool) []ast.Node {
 	var unused []ast.Node
 
-	comp.used, _, _ = comp.collectUsed(false)
-	structs, flags, strflags := comp.collectUsed(true)
+	comp.used, _, _, _ = comp.collectUsed(false, nil)
+	structs, flags, strflags, typedefs := comp.collectUsed(true, calls)
+	if calls == nil {
+		// Typedefs used by unused structs are not reported as unused.
+		typedefs = comp.usedTypedefs
+	}
 
 	note := func(n ast.Node) {
 		if pos, _, _ := n.Info(); pos.Builtin() {
@@ -710,7 +736,7 @@ func (comp *compiler) collectUnused() []ast.Node {
 		}
 	}
 	for name, n := range comp.typedefs {
-		if !comp.usedTypedefs[name] {
+		if !typedefs[name] {
 			note(n)
 		}
 	}
@@ -718,33 +744,41 @@ func (comp *compiler) collectUnused() []ast.Node {
 	return unused
 }
 
-func (comp *compiler) collectUsed(all bool) (structs, flags, strflags map[string]bool) {
+func (comp *compiler) collectUsed(all bool, calls func(*ast.Call) bool) (structs, flags, strflags,
+	typedefs map[string]bool) {
 	structs = make(map[string]bool)
 	flags = make(map[string]bool)
 	strflags = make(map[string]bool)
+	typedefs = make(map[string]bool)
 	for _, decl := range comp.desc.Nodes {
 		switch n := decl.(type) {
 		case *ast.Call:
-			if !all && n.NR == ^uint64(0) {
+			if !all && n.NR == ^uint64(0) || calls != nil && !calls(n) {
 				break
 			}
 			for _, arg := range n.Args {
-				comp.collectUsedType(structs, flags, strflags, arg.Type, true)
+				comp.collectUsedType(structs, flags, strflags, typedefs, arg.Type, true)
 			}
 			if n.Ret != nil {
-				comp.collectUsedType(structs, flags, strflags, n.Ret, true)
+				comp.collectUsedType(structs, flags, strflags, typedefs, n.Ret, true)
 			}
 		}
 	}
 	return
 }
 
-func (comp *compiler) collectUsedType(structs, flags, strflags map[string]bool, t *ast.Type, isArg bool) {
+func (comp *compiler) collectUsedType(structs, flags, strflags, typedefs map[string]bool, t *ast.Type, isArg bool) {
+	for _, name := range comp.typedefTypes[t] {
+		typedefs[name] = true
+	}
 	desc := comp.getTypeDesc(t)
 	if desc == typeResource {
 		r := comp.resources[t.Ident]
 		for r != nil && !structs[r.Name.Name] {
 			structs[r.Name.Name] = true
+			for _, name := range comp.typedefTypes[r.Base] {
+				typedefs[name] = true
+			}
 			r = comp.resources[r.Base.Ident]
 		}
 		return
@@ -756,7 +790,7 @@ func (comp *compiler) collectUsedType(structs, flags, strflags map[string]bool,
 		structs[t.Ident] = true
 		s := comp.structs[t.Ident]
 		for _, fld := range s.Fields {
-			comp.collectUsedType(structs, flags, strflags, fld.Type, false)
+			comp.collectUsedType(structs, flags, strflags, typedefs, fld.Type, false)
 		}
 		return
 	}
@@ -774,13 +808,13 @@ func (comp *compiler) collectUsedType(structs, flags, strflags map[string]bool,
 	_, args, _ := comp.getArgsBase(t, isArg)
 	for i, arg := range args {
 		if desc.Args[i].Type == typeArgType {
-			comp.collectUsedType(structs, flags, strflags, arg, desc.Args[i].IsArg)
+			comp.collectUsedType(structs, flags, strflags, typedefs, arg, desc.Args[i].IsArg)
 		}
 	}
 }
 
 func (comp *compiler) checkUnused() {
-	for _, n := range comp.collectUnused() {
+	for _, n := range comp.collectUnused(nil) {
 		pos, typ, name := n.Info()
 		comp.error(pos, "unused %v %v", typ, name)
 	}
@@ -1156,6 +1190,7 @@ func (comp *compiler) replaceTypedef(ctx *checkCtx, t *ast.Type, flags checkFlag
 		return
 	}
 	comp.usedTypedefs[typedefName] = true
+	comp.typedefTypes[t] = append(comp.typedefTypes[t], typedefName)
 	err0 := comp.errors
 	defer func() {
 		comp.brokenTypedefs[fullTypeName] = err0 != comp.errors
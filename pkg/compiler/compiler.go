@@ -61,6 +61,7 @@ func createCompiler(desc *ast.Description, target *targets.Target, eh ast.ErrorH
 		strFlags:       make(map[string]*ast.StrFlags),
 		used:           make(map[string]bool),
 		usedTypedefs:   make(map[string]bool),
+		typedefTypes:   make(map[*ast.Type][]string),
 		brokenTypedefs: make(map[string]bool),
 		structVarlen:   make(map[string]bool),
 		structTypes:    make(map[string]prog.Type),
@@ -134,6 +135,7 @@ type compiler struct {
 	strFlags       map[string]*ast.StrFlags
 	used           map[string]bool // contains used structs/resources
 	usedTypedefs   map[string]bool
+	typedefTypes   map[*ast.Type][]string // typedefs replaced in each type
 	brokenTypedefs map[string]bool
 
 	structVarlen   map[string]bool
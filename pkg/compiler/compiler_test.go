@@ -328,6 +328,52 @@ func TestCollectUnused(t *testing.T) {
 	}
 }
 
+func TestCollectUnusedSubsets(t *testing.T) {
+	t.Parallel()
+	const input = `
+		resource r0[int32]
+		foo$0(a ptr[in, s0]) r0
+		foo$1(a ptr[in, t0[int8]], b r0)
+		s0 {
+			f0	int8
+		}
+		type t0[T] {
+			f0	T
+			f1	t1
+		}
+		type t1 int64
+	`
+	desc := ast.Parse([]byte(input), "input", nil)
+	if desc == nil {
+		t.Fatal("failed to parse")
+	}
+	subsets := []func(*ast.Call) bool{
+		func(call *ast.Call) bool { return call.Name.Name == "foo$0" },
+		func(call *ast.Call) bool { return call.Name.Name == "foo$1" },
+		func(call *ast.Call) bool { return true },
+	}
+	res, err := CollectUnusedSubsets(desc, targets.List[targets.TestOS][targets.TestArch64], nil, subsets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{
+		{"t0", "t0[int8]", "t1"},
+		{"s0"},
+		{},
+	}
+	for i, nodes := range res {
+		names := []string{}
+		for _, n := range nodes {
+			_, _, name := n.Info()
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, want[i]) {
+			t.Errorf("subset %d: want unused %v, got %v", i, want[i], names)
+		}
+	}
+}
+
 func TestFlattenFlags(t *testing.T) {
 	t.Parallel()
 	const input = `
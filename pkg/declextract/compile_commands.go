@@ -0,0 +1,269 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+type CompileCommand struct {
+	Command   string
+	Arguments []string // alternative to Command used by some generators (e.g. ninja)
+	Directory string
+	File      string
+	// Compilation database the command was loaded from (set by LoadCompileCommands).
+	Database string `json:"-"`
+}
+
+// command returns the command line regardless of the form used in the compilation database.
+func (cmd *CompileCommand) command() string {
+	if cmd.Command == "" {
+		return strings.Join(cmd.Arguments, " ")
+	}
+	return cmd.Command
+}
+
+// DefaultExcludePaths are kernel source dirs that contain files compiled during the kernel build,
+// but not a part of the kernel itself (and thus not a part of the syscall surface).
+var DefaultExcludePaths = []string{
+	"samples",
+	"scripts",
+	"tools",
+}
+
+// LoadCompileCommands loads commands for kernel source files from the compilation database
+// (compile_commands.json) in the order they appear in the database.
+// Files matching any of the exclude patterns (see filepath.Match) are omitted. Patterns are matched
+// against file paths relative to the kernel source dir and all their parent dirs,
+// so e.g. "tools" excludes all files in the tools dir. If sourcePrefix is set, only files in this dir
+// (absolute or relative to the kernel source dir) are loaded (e.g. if the database covers more than the kernel).
+// If file is "-", the commands are read from stdin (e.g. pre-filtered by another tool), they must be a subset
+// of Config.CompilationDatabase since the binary gets the compiler flags from it (CompileCommand.Database is empty).
+// Notes about the commands are logged to the logger (slog.Default() if nil).
+func LoadCompileCommands(file, sourceDir string, exclude []string, sourcePrefix string,
+	logger *slog.Logger) ([]CompileCommand, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	if sourcePrefix != "" && !filepath.IsAbs(sourcePrefix) {
+		sourcePrefix = filepath.Join(sourceDir, sourcePrefix)
+	}
+	for _, pattern := range exclude {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad exclude pattern %q: %w", pattern, err)
+		}
+	}
+	data, err := readCompilationDatabase(file)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%v does not exist, build the kernel with clang and generate it with"+
+			" 'make CC=clang compile_commands.json' in the kernel build dir", file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cmds []CompileCommand
+	if err := json.Unmarshal(data, &cmds); err != nil {
+		return nil, err
+	}
+	// Files may be relative to the command dir, but we need absolute paths to pass them to the binary
+	// and to match against source dirs.
+	for i := range cmds {
+		if !filepath.IsAbs(cmds[i].File) {
+			cmds[i].File = filepath.Join(cmds[i].Directory, cmds[i].File)
+		}
+		cmds[i].File = filepath.Clean(cmds[i].File)
+		if file != "-" {
+			cmds[i].Database = file
+		}
+	}
+	// Remove commands that don't relate to the kernel build
+	// (probably some host tools, etc).
+	rsp := newResponseFiles(logger)
+	cmds = slices.DeleteFunc(cmds, func(cmd CompileCommand) bool {
+		command := rsp.expand(cmd)
+		return !strings.HasSuffix(cmd.File, ".c") ||
+			// Files compiled with gcc are not a part of the kernel
+			// (assuming compile commands were generated with make CC=clang).
+			// They are probably a part of some host tool.
+			strings.HasPrefix(command, "gcc") ||
+			// KBUILD should add this define all kernel files.
+			!strings.Contains(command, "-DKBUILD_BASENAME")
+	})
+	if len(cmds) == 0 {
+		return nil, fmt.Errorf("no kernel files found in %v (the kernel needs to be built with clang)", file)
+	}
+	total := len(cmds)
+	cmds = slices.DeleteFunc(cmds, func(cmd CompileCommand) bool {
+		return isExcluded(sourceDir, cmd, exclude) || !hasSourcePrefix(sourcePrefix, cmd)
+	})
+	if len(cmds) == 0 {
+		return nil, fmt.Errorf("all %v kernel files in %v were removed by the exclude patterns"+
+			" and the source prefix (-exclude/-source-prefix)", total, file)
+	}
+	cmds = dedupCompileCommands(cmds, rsp, logger)
+	// LTO builds compile files to bitcode, but the binary only runs the frontend, so the files are
+	// extracted as usual. Still worth noting in case the binary's clang does not support the LTO flags.
+	lto := 0
+	for _, cmd := range cmds {
+		if isLTO(rsp.expand(cmd)) {
+			lto++
+		}
+	}
+	if lto != 0 {
+		logger.Info(fmt.Sprintf("%v/%v files are compiled with LTO, if the binary fails on them,"+
+			" the LTO flags may need to be overridden with clang args (e.g. -fno-lto)", lto, len(cmds)),
+			"phase", "load")
+	}
+	return cmds, nil
+}
+
+// isLTO says if the command compiles the file with LTO (-flto or -flto=thin/full, unless overridden by -fno-lto).
+func isLTO(command string) bool {
+	lto := false
+	for _, arg := range strings.Fields(command) {
+		switch {
+		case arg == "-flto" || strings.HasPrefix(arg, "-flto="):
+			lto = true
+		case arg == "-fno-lto":
+			lto = false
+		}
+	}
+	return lto
+}
+
+func readCompilationDatabase(file string) ([]byte, error) {
+	if file == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(file)
+}
+
+// responseFiles caches contents of GNU-style response files (@file arguments),
+// since the same file is usually referenced by lots of commands.
+type responseFiles struct {
+	files  map[string]string
+	logger *slog.Logger
+}
+
+func newResponseFiles(logger *slog.Logger) *responseFiles {
+	return &responseFiles{
+		files:  make(map[string]string),
+		logger: logger,
+	}
+}
+
+// Response files may include other response files, but we don't follow them infinitely.
+const maxResponseFileDepth = 10
+
+// expand returns the command line with all response files replaced with their contents
+// (unreadable files are left as is).
+func (rsp *responseFiles) expand(cmd CompileCommand) string {
+	return rsp.expandCommand(cmd.Directory, cmd.command(), 0)
+}
+
+func (rsp *responseFiles) expandCommand(dir, command string, depth int) string {
+	if !strings.Contains(command, "@") || depth >= maxResponseFileDepth {
+		return command
+	}
+	args := strings.Fields(command)
+	for i, arg := range args {
+		file, ok := strings.CutPrefix(arg, "@")
+		if !ok || file == "" {
+			continue
+		}
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(dir, file)
+		}
+		data, ok := rsp.files[file]
+		if !ok {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				rsp.logger.Debug(fmt.Sprintf("failed to read response file %v: %v", file, err), "phase", "load")
+				content = []byte(arg)
+			}
+			data = string(content)
+			rsp.files[file] = data
+		}
+		if data != arg {
+			args[i] = rsp.expandCommand(dir, data, depth+1)
+		}
+	}
+	return strings.Join(args, " ")
+}
+
+// dedupCompileCommands leaves a single command for each file. A file may be compiled several times
+// with different flags, we prefer the command with the most defines as it's most likely the one
+// used for the kernel itself. The order of files is preserved.
+func dedupCompileCommands(cmds []CompileCommand, rsp *responseFiles, logger *slog.Logger) []CompileCommand {
+	index := make(map[string]int)
+	var res []CompileCommand
+	duplicates := 0
+	for _, cmd := range cmds {
+		file := cmd.File
+		idx, ok := index[file]
+		if !ok {
+			index[file] = len(res)
+			res = append(res, cmd)
+			continue
+		}
+		duplicates++
+		logger.Debug("file has several compile commands", "phase", "load", "file", file)
+		prev := res[idx]
+		defines, prevDefines := countDefines(rsp.expand(cmd)), countDefines(rsp.expand(prev))
+		if defines > prevDefines || defines == prevDefines && cmd.command() < prev.command() {
+			res[idx] = cmd
+		}
+	}
+	if duplicates != 0 {
+		logger.Info(fmt.Sprintf("collapsed %v duplicate compile commands", duplicates), "phase", "load")
+	}
+	return res
+}
+
+func countDefines(command string) int {
+	defines := 0
+	for _, arg := range strings.Fields(command) {
+		if strings.HasPrefix(arg, "-D") {
+			defines++
+		}
+	}
+	return defines
+}
+
+func isExcluded(sourceDir string, cmd CompileCommand, exclude []string) bool {
+	file, ok := RelativePath(sourceDir, cmd.Directory, cmd.File)
+	if !ok {
+		return false
+	}
+	for ; file != "." && file != string(filepath.Separator); file = filepath.Dir(file) {
+		for _, pattern := range exclude {
+			if match, _ := filepath.Match(pattern, file); match {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hasSourcePrefix(sourcePrefix string, cmd CompileCommand) bool {
+	if sourcePrefix == "" {
+		return true
+	}
+	_, ok := relativePath(sourcePrefix, sourcePrefix, cmd.File)
+	return ok
+}
+
+func ShuffleCompileCommands(cmds []CompileCommand, seed int64) {
+	rand.New(rand.NewSource(seed)).Shuffle(len(cmds), func(i, j int) {
+		cmds[i], cmds[j] = cmds[j], cmds[i]
+	})
+}
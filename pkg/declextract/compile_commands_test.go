@@ -0,0 +1,307 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/syzkaller/pkg/osutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadCompileCommands(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "compile_commands.json")
+	data := `[
+	{
+		"command": "clang -c -DKBUILD_BASENAME='\"read_write\"' -o fs/read_write.o /linux/fs/read_write.c",
+		"directory": "/linux",
+		"file": "/linux/fs/read_write.c"
+	},
+	{
+		"arguments": ["clang", "-c", "-DKBUILD_BASENAME='\"open\"'", "-o", "fs/open.o", "/linux/fs/open.c"],
+		"directory": "/linux",
+		"file": "/linux/fs/open.c"
+	},
+	{
+		"arguments": ["gcc", "-c", "-DKBUILD_BASENAME='\"fixdep\"'", "-o", "fixdep.o", "/linux/scripts/fixdep.c"],
+		"directory": "/linux",
+		"file": "/linux/scripts/fixdep.c"
+	},
+	{
+		"arguments": ["clang", "-c", "-o", "tool.o", "/linux/tools/tool.c"],
+		"directory": "/linux",
+		"file": "/linux/tools/tool.c"
+	},
+	{
+		"arguments": ["clang", "-c", "-DKBUILD_BASENAME='\"head\"'", "-o", "head.o", "/linux/arch/x86/head.S"],
+		"directory": "/linux",
+		"file": "/linux/arch/x86/head.S"
+	}
+]`
+	if err := osutil.WriteFile(file, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	cmds, err := LoadCompileCommands(file, "/linux", nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, cmd := range cmds {
+		files = append(files, cmd.File)
+	}
+	assert.ElementsMatch(t, []string{"/linux/fs/read_write.c", "/linux/fs/open.c"}, files)
+	assert.Equal(t, file, cmds[0].Database)
+
+	// The same commands piped to stdin.
+	stdin, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stdin.Close()
+	defer func(prev *os.File) { os.Stdin = prev }(os.Stdin)
+	os.Stdin = stdin
+	stdinCmds, err := LoadCompileCommands("-", "/linux", nil, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, stdinCmds, len(cmds))
+	for i := range cmds {
+		assert.Equal(t, cmds[i].File, stdinCmds[i].File)
+		assert.Empty(t, stdinCmds[i].Database)
+	}
+}
+
+func TestExcludeCompileCommands(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "compile_commands.json")
+	data := `[
+	{
+		"command": "clang -c -DKBUILD_BASENAME='\"read_write\"' /src/linux/fs/read_write.c",
+		"directory": "/build/linux",
+		"file": "/src/linux/fs/read_write.c"
+	},
+	{
+		"command": "clang -c -DKBUILD_BASENAME='\"gen\"' scripts/mod/gen.c",
+		"directory": "/build/linux",
+		"file": "scripts/mod/gen.c"
+	},
+	{
+		"command": "clang -c -DKBUILD_BASENAME='\"sample\"' /src/linux/samples/bpf/sample.c",
+		"directory": "/build/linux",
+		"file": "/src/linux/samples/bpf/sample.c"
+	},
+	{
+		"command": "clang -c -DKBUILD_BASENAME='\"foo_test\"' /src/linux/drivers/foo/foo_test.c",
+		"directory": "/build/linux",
+		"file": "/src/linux/drivers/foo/foo_test.c"
+	}
+]`
+	if err := osutil.WriteFile(file, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	load := func(exclude []string) []string {
+		cmds, err := LoadCompileCommands(file, "/src/linux", exclude, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var files []string
+		for _, cmd := range cmds {
+			files = append(files, cmd.File)
+		}
+		return files
+	}
+	assert.Equal(t, []string{"/src/linux/fs/read_write.c", "/src/linux/drivers/foo/foo_test.c"},
+		load(DefaultExcludePaths))
+	assert.Equal(t, []string{"/src/linux/fs/read_write.c", "/build/linux/scripts/mod/gen.c"},
+		load([]string{"samples", "drivers/*/*_test.c"}))
+	_, err := LoadCompileCommands(file, "/src/linux", []string{"["}, "", nil)
+	assert.Error(t, err)
+	for _, prefix := range []string{"fs", "/src/linux/fs/"} {
+		cmds, err := LoadCompileCommands(file, "/src/linux", nil, prefix, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, cmds, 1, prefix)
+		assert.Equal(t, "/src/linux/fs/read_write.c", cmds[0].File, prefix)
+	}
+	_, err = LoadCompileCommands(file, "/src/linux", nil, "/src/linux/mm", nil)
+	assert.ErrorContains(t, err, "all 4 kernel files")
+	_, err = LoadCompileCommands(file, "/src/linux", []string{"*"}, "", nil)
+	assert.ErrorContains(t, err, "all 4 kernel files")
+}
+
+func TestLoadCompileCommandsErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := LoadCompileCommands(filepath.Join(dir, "compile_commands.json"), "/linux", nil, "", nil)
+	assert.ErrorContains(t, err, "make CC=clang compile_commands.json")
+	for _, data := range []string{
+		`[]`,
+		`[{"command": "gcc -c -DKBUILD_BASENAME='\"fixdep\"' fixdep.c", "directory": "/linux", "file": "fixdep.c"}]`,
+	} {
+		file := filepath.Join(dir, "compile_commands.json")
+		if err := osutil.WriteFile(file, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadCompileCommands(file, "/linux", nil, "", nil)
+		assert.ErrorContains(t, err, "no kernel files found")
+	}
+}
+
+func TestDedupCompileCommands(t *testing.T) {
+	cmds := []CompileCommand{
+		{Command: "clang -DKBUILD_BASENAME=a -c a.c", Directory: "/linux", File: "/linux/a.c"},
+		{Command: "clang -DKBUILD_BASENAME=b -c b.c", Directory: "/linux", File: "/linux/b.c"},
+		{Command: "clang -DKBUILD_BASENAME=a -DMODULE -c a.c", Directory: "/linux", File: "/linux/a.c"},
+		{Command: "clang -DKBUILD_BASENAME=b -Os -c b.c", Directory: "/linux", File: "/linux/b.c"},
+	}
+	logs := new(bytes.Buffer)
+	logger := slog.New(slog.NewTextHandler(logs, nil))
+	assert.Equal(t, []CompileCommand{cmds[2], cmds[3]}, dedupCompileCommands(cmds, newResponseFiles(logger), logger))
+	assert.Contains(t, logs.String(), "collapsed 2 duplicate compile commands")
+}
+
+func TestResponseFiles(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"kbuild.rsp":    "-DKBUILD_MODNAME='\"read_write\"' -DKBUILD_BASENAME='\"read_write\"'\n",
+		"nested.rsp":    "-c @kbuild.rsp\n",
+		"host.rsp":      "-c -O2\n",
+		"recursive.rsp": "@recursive.rsp\n",
+	}
+	for name, data := range files {
+		if err := osutil.WriteFile(filepath.Join(dir, name), []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	file := filepath.Join(dir, "compile_commands.json")
+	data := `[
+	{
+		"command": "clang @nested.rsp -o fs/read_write.o /linux/fs/read_write.c",
+		"directory": "` + dir + `",
+		"file": "/linux/fs/read_write.c"
+	},
+	{
+		"arguments": ["clang", "@` + filepath.Join(dir, "kbuild.rsp") + `", "-o", "fs/open.o", "/linux/fs/open.c"],
+		"directory": "/linux",
+		"file": "/linux/fs/open.c"
+	},
+	{
+		"command": "clang @host.rsp -o tool.o /linux/tool.c",
+		"directory": "` + dir + `",
+		"file": "/linux/tool.c"
+	},
+	{
+		"command": "clang @recursive.rsp @nonexistent.rsp -o tool2.o /linux/tool2.c",
+		"directory": "` + dir + `",
+		"file": "/linux/tool2.c"
+	}
+]`
+	if err := osutil.WriteFile(file, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	logs := new(bytes.Buffer)
+	logger := slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	cmds, err := LoadCompileCommands(file, "/linux", nil, "", logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var loaded []string
+	for _, cmd := range cmds {
+		loaded = append(loaded, cmd.File)
+	}
+	assert.Equal(t, []string{"/linux/fs/read_write.c", "/linux/fs/open.c"}, loaded)
+	assert.Contains(t, logs.String(), "failed to read response file "+filepath.Join(dir, "nonexistent.rsp"))
+}
+
+func TestRelativeCompileCommands(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "compile_commands.json")
+	data := `[
+	{
+		"command": "clang -c -DKBUILD_BASENAME='\"read_write\"' -o fs/read_write.o fs/read_write.c",
+		"directory": "/linux",
+		"file": "fs/read_write.c"
+	},
+	{
+		"command": "clang -c -DKBUILD_BASENAME='\"open\"' -o fs/open.o /linux/fs/open.c",
+		"directory": "/linux",
+		"file": "/linux/fs/open.c"
+	},
+	{
+		"command": "clang -c -DKBUILD_BASENAME='\"stat\"' -o stat.o ../stat.c",
+		"directory": "/linux/fs/build",
+		"file": "../stat.c"
+	},
+	{
+		"command": "clang -c -DKBUILD_BASENAME='\"open\"' -DMODULE -o fs/open.o fs/open.c",
+		"directory": "/linux",
+		"file": "fs/open.c"
+	},
+	{
+		"command": "clang -c -DKBUILD_BASENAME='\"tool\"' -o tool.o tool.c",
+		"directory": "/linux/tools",
+		"file": "tool.c"
+	}
+]`
+	if err := osutil.WriteFile(file, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	cmds, err := LoadCompileCommands(file, "/linux", DefaultExcludePaths, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var files []string
+	for _, cmd := range cmds {
+		files = append(files, cmd.File)
+	}
+	assert.Equal(t, []string{"/linux/fs/read_write.c", "/linux/fs/open.c", "/linux/fs/stat.c"}, files)
+	assert.Contains(t, cmds[1].Command, "-DMODULE")
+}
+
+func TestLTOCompileCommands(t *testing.T) {
+	dir := t.TempDir()
+	if err := osutil.WriteFile(filepath.Join(dir, "lto.rsp"), []byte("-flto=thin -fsplit-lto-unit\n")); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "compile_commands.json")
+	// LTO commands are kept, they are extracted as usual.
+	data := `[
+	{
+		"arguments": ["clang", "-c", "-DKBUILD_BASENAME='\"open\"'", "-flto=thin", "/linux/fs/open.c"],
+		"directory": "/linux",
+		"file": "/linux/fs/open.c"
+	},
+	{
+		"command": "clang -c -DKBUILD_BASENAME='\"read_write\"' @lto.rsp /linux/fs/read_write.c",
+		"directory": "` + dir + `",
+		"file": "/linux/fs/read_write.c"
+	},
+	{
+		"command": "clang -c -DKBUILD_BASENAME='\"stat\"' -flto -fno-lto /linux/fs/stat.c",
+		"directory": "/linux",
+		"file": "/linux/fs/stat.c"
+	}
+]`
+	if err := osutil.WriteFile(file, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	logs := new(bytes.Buffer)
+	cmds, err := LoadCompileCommands(file, "/linux", nil, "", slog.New(slog.NewTextHandler(logs, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, logs.String(), "2/3 files are compiled with LTO")
+	rsp := newResponseFiles(slog.Default())
+	lto := make(map[string]bool)
+	for _, cmd := range cmds {
+		lto[cmd.File] = isLTO(rsp.expand(cmd))
+	}
+	assert.Equal(t, map[string]bool{
+		"/linux/fs/open.c":       true,
+		"/linux/fs/read_write.c": true,
+		"/linux/fs/stat.c":       false,
+	}, lto)
+}
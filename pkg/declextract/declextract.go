@@ -0,0 +1,894 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+// Package declextract extracts syscall descriptions and interface information from the kernel sources
+// using the syz-declextract clang tool. See tools/syz-declextract for the command line interface.
+package declextract
+
+import (
+	"bytes"
+	gocontext "context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/syzkaller/pkg/ast"
+	"github.com/google/syzkaller/pkg/compiler"
+	"github.com/google/syzkaller/pkg/hash"
+	"github.com/google/syzkaller/pkg/osutil"
+	"github.com/google/syzkaller/pkg/subsystem"
+	_ "github.com/google/syzkaller/pkg/subsystem/lists"
+	"github.com/google/syzkaller/sys/targets"
+)
+
+var target = targets.Get(targets.Linux, targets.AMD64)
+
+type Config struct {
+	// Path to the syz-declextract binary.
+	Binary              string
+	KernelSrc           string
+	KernelObj           string
+	CompilationDatabase string
+	// Build dirs of the same kernel sources with other configs (optional). Commands from their
+	// compilation databases (see CompileCommand.Database) are extracted in addition to KernelObj commands,
+	// and the results are merged.
+	ExtraKernelObj []string
+	// Source dir of an out-of-tree kernel module to extract (optional). Module files and includes
+	// are relative to this dir, while kernel headers are still relative to KernelSrc/KernelObj.
+	ModuleSrc string
+	// Commands for the files to extract (see LoadCompileCommands).
+	CompileCommands []CompileCommand
+	// If set, outputs of the binary are cached in this dir.
+	CacheDir string
+	// Use outputs cached in CacheDir if present.
+	UseCache bool
+	// Use only outputs cached in CacheDir and never run the binary (files without cached outputs are errors).
+	CacheOnly bool
+	// Number of retries for binary invocations that failed due to transient reasons (e.g. OOM kills).
+	Retries int
+	// Number of files extracted (and syscall tables read) in parallel, runtime.NumCPU() if 0.
+	Concurrency int
+	// Additional arguments passed to clang.
+	ClangArgs []string
+	// Syscalls to exclude from the descriptions in addition to the default list (see ParseSyscallList).
+	SkipSyscalls map[string]bool
+	// Additional function renames (see ParseRenameList), the default list is always used.
+	RenameSyscalls map[string][]string
+	// Globs of syscall table files (relative to KernelSrc) read in addition to the tables found
+	// in the arch dirs, for kernels with unusual layouts. Tables outside of the arch dirs
+	// are not attributed to any arch.
+	SyscallTables []string
+	// Read only SyscallTables, and don't look for tables in the arch dirs.
+	OnlySyscallTables bool
+	// Generate $compat variants of syscalls for compat syscall entries
+	// (the binary extracts COMPAT_SYSCALL_DEFINE functions only in this mode).
+	Compat bool
+	// Path to the auto-generated descriptions file,
+	// the rest of descriptions for the target OS are expected in the same dir.
+	AutoFile string
+	// If set, the extracted descriptions are merged into these descriptions
+	// (used for incremental updates where only some of the files are extracted).
+	PrevDescriptions *ast.Description
+	// Source files of the nodes in PrevDescriptions (see ParseProvenance). If set, only the previous nodes
+	// that come from the files in CompileCommands are replaced, so nodes with the same name from other files
+	// are preserved. Otherwise, previous nodes are replaced by the new nodes with the same type and name.
+	PrevProvenance map[string][]string
+	// Record source files of each description node in Result.Provenance.
+	Provenance bool
+	// Precede each call in the descriptions with a comment with subsystems and source files of the call.
+	AnnotateCalls bool
+	// Subsystems used to attribute interfaces to, the built-in list for the target OS is used if not set
+	// (see LoadSubsystems).
+	Subsystems []*subsystem.Subsystem
+	// Record the primary subsystem of each interface in Interface.PrimarySubsystem.
+	PrimarySubsystems bool
+	// Don't attribute interfaces (and annotated calls) to subsystems at all, Interface.Subsystems is empty.
+	// This saves time on runs that don't need subsystems.
+	NoSubsystems bool
+	// Mapping of access levels from INTERFACE comments to the canonical vocabulary (see ParseAccessMap).
+	// If set, levels that are not in the map are kept as is and reported as warnings.
+	AccessMap map[string]string
+	// Log interfaces with unspecified key fields (grouped by type), they are not counted as warnings.
+	WarnIncomplete bool
+	// Log a summary of includes that could not be made relative to the kernel dirs (with the files
+	// they come from) after all files are processed, they are not counted as warnings.
+	WarnIncludes bool
+	// Includes added at the top of the descriptions before all other includes
+	// (DefaultHeaderIncludes if nil, other kernel headers don't compile without them).
+	HeaderIncludes []string
+	// Merge structs with the same name that differ only in the order of fields.
+	MergeStructs bool
+	// Extract only interfaces, Result.Descriptions is not set in this mode,
+	// and presence of auto descriptions is checked against the existing AutoFile.
+	InfoOnly bool
+	// If closed, no new files are extracted, outputs of the files being extracted are still cached,
+	// and Extract fails with ErrInterrupted. The run can then be resumed with UseCache.
+	Shutdown <-chan struct{}
+	// If canceled, extraction is aborted: binaries running on in-flight files are killed (their outputs
+	// are not cached), and Extract fails with the context error once all workers have exited.
+	Context gocontext.Context
+	// If set, called once all files are extracted, before the existing descriptions are read
+	// (e.g. to lock them against concurrent runs until the new descriptions are written).
+	BeforeFinish func()
+	// Types of nodes (see NodeTypes) dropped from the extracted nodes before NodeTransform,
+	// e.g. "intflags" if the flags are maintained in manual descriptions.
+	ExcludeNodeTypes []string
+	// If set, the nodes as they were extracted from each file (calls are already renamed to syscall names)
+	// are written to this file and the merged interfaces to this file with .info suffix, before
+	// the descriptions are assembled. This helps to tell extraction problems from assembly problems.
+	RawFile string
+	// Optional transformation of all extracted nodes (in no particular order) before they are sorted,
+	// deduplicated and merged. Provenance is not known for nodes that were changed or added.
+	NodeTransform func([]ast.Node) []ast.Node
+	// Limit of the address space of each binary process in bytes (0 means no limit, Linux only).
+	// Files that the binary runs out of memory on with the limit fail with ToolMemLimit errors,
+	// instead of the OOM killer killing random processes.
+	MemLimit uint64
+	// Check that all calls in the final descriptions correspond to syscall table entries
+	// (or renames), calls that don't are reported as warnings.
+	Validate bool
+	// Apply additional normalizations that don't change semantics of the descriptions, so that
+	// semantically equal extractions produce byte-identical descriptions (see canonicalizeDescriptions).
+	Canonical bool
+	// Values of consts for the target OS (see compiler.DeserializeConstFile). If set, __NR_ consts
+	// of the extracted syscalls are checked against syscall numbers in the tables for each arch,
+	// mismatches (usually a wrong function mapped to the syscall) are reported as warnings.
+	SyscallConsts *compiler.ConstFile
+	// Logger for diagnostic messages, slog.Default() is used if not set.
+	// Messages have "phase" (extract/parse/finish) and "file" (if relevant) attributes.
+	Logger *slog.Logger
+}
+
+type Result struct {
+	Descriptions *ast.Description
+	Interfaces   []Interface
+	// Source files for each node in Descriptions (if Config.Provenance is set).
+	Provenance map[ast.Node][]string
+	Timings    []FileTiming
+	// Sorted files that produced no nodes at all (neither descriptions nor interfaces).
+	EmptyFiles []string
+	// Number of problems found in the extracted data (they are logged as well).
+	Warnings int
+}
+
+var ErrInterrupted = errors.New("extraction interrupted")
+
+type FileTiming struct {
+	File     string
+	Duration time.Duration // time spent in the syz-declextract binary
+}
+
+// Extract runs the syz-declextract binary on all files and combines the outputs
+// into the final descriptions and interfaces.
+func Extract(cfg *Config) (*Result, error) {
+	for _, inc := range cfg.HeaderIncludes {
+		if headerNodes("", []string{inc}) == nil {
+			return nil, fmt.Errorf("bad header include %q", inc)
+		}
+	}
+	for _, typ := range cfg.ExcludeNodeTypes {
+		if !slices.Contains(NodeTypes, typ) {
+			return nil, fmt.Errorf("unknown node type %q (%v)", typ, strings.Join(NodeTypes, ", "))
+		}
+	}
+	if cfg.NoSubsystems && (cfg.Subsystems != nil || cfg.PrimarySubsystems) {
+		return nil, fmt.Errorf("NoSubsystems can't be combined with Subsystems and PrimarySubsystems")
+	}
+	skipSyscalls := skipSyscallList(cfg)
+	renames, err := renameList(cfg)
+	if err != nil {
+		return nil, err
+	}
+	ctx := &context{
+		cfg:           cfg,
+		skipSyscalls:  skipSyscalls,
+		interfaces:    make(map[string]Interface),
+		syscallMapErr: make(chan error, 1),
+	}
+	if !cfg.NoSubsystems {
+		subsystems := subsystemList(cfg.Subsystems)
+		if len(subsystems) == 0 {
+			ctx.warnf("load", "", "no subsystems are defined for %v, interfaces are not attributed"+
+				" to subsystems (set NoSubsystems if this is intended)", target.OS)
+		}
+		ctx.extractor = subsystem.MakeExtractor(subsystems)
+	}
+	// Walking the syscall tables may be slow on cold caches, and the map is not needed
+	// until the first output is processed, so it's read concurrently with the first binary runs.
+	go func() {
+		syscallNameMap, compatNameMap, err := ctx.readSyscallMap(skipSyscalls)
+		if err == nil {
+			if !cfg.Compat {
+				compatNameMap = nil
+			}
+			mergeRenames(syscallNameMap, renames)
+			ctx.syscallNameMap, ctx.compatNameMap = syscallNameMap, compatNameMap
+		}
+		ctx.syscallMapErr <- err
+	}()
+	if cfg.Provenance || cfg.AnnotateCalls {
+		ctx.nodeFiles = make(map[string][]string)
+	}
+	if !cfg.InfoOnly {
+		if ctx.version, err = ctx.binaryVersion(); err != nil {
+			return nil, err
+		}
+	}
+	if err := ctx.processFiles(); err != nil {
+		return nil, err
+	}
+	if err := ctx.waitSyscallMap(); err != nil {
+		return nil, err
+	}
+	if cfg.BeforeFinish != nil {
+		cfg.BeforeFinish()
+	}
+	if cfg.RawFile != "" {
+		if err := ctx.writeRaw(); err != nil {
+			return nil, err
+		}
+	}
+	var desc *ast.Description
+	if !cfg.InfoOnly {
+		if len(cfg.ExcludeNodeTypes) != 0 {
+			ctx.nodes = excludeNodeTypes(ctx.nodes, cfg.ExcludeNodeTypes)
+		}
+		if cfg.NodeTransform != nil {
+			ctx.nodes = cfg.NodeTransform(ctx.nodes)
+		}
+		if err := ctx.finishDescriptions(); err != nil {
+			return nil, err
+		}
+		desc = &ast.Description{
+			Nodes: ctx.nodes,
+		}
+		if err := ctx.removeUnused(desc); err != nil {
+			return nil, err
+		}
+		if cfg.Validate {
+			ctx.validateCalls(desc)
+		}
+		if cfg.Canonical {
+			canonicalizeDescriptions(desc)
+		}
+		if cfg.AnnotateCalls {
+			ctx.annotateCalls(desc)
+		}
+	}
+	interfaces := ctx.finishInterfaces()
+	if err := ctx.checkDescriptionPresence(interfaces, desc); err != nil {
+		return nil, err
+	}
+	if cfg.SyscallConsts != nil {
+		ctx.checkSyscallNumbers(interfaces, ctx.syscallDescs)
+	}
+	res := &Result{
+		Descriptions: desc,
+		Interfaces:   interfaces,
+		Timings:      ctx.timings,
+		EmptyFiles:   ctx.emptyFiles,
+		Warnings:     ctx.warnings,
+	}
+	if cfg.Provenance {
+		res.Provenance = ctx.provenance
+	}
+	return res, nil
+}
+
+// binaryVersion returns version of the binary that produced the outputs (see Version).
+// The version is saved in the cache dir, so that it's known in the CacheOnly mode.
+func (ctx *context) binaryVersion() (string, error) {
+	versionFile := ""
+	if ctx.cfg.CacheDir != "" {
+		versionFile = filepath.Join(ctx.cfg.CacheDir, "version")
+	}
+	if ctx.cfg.CacheOnly {
+		data, err := os.ReadFile(versionFile)
+		if err != nil {
+			ctx.warnf("extract", "", "unknown version of the binary that populated the cache: %v", err)
+			return "", nil
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	version, err := Version(ctx.cfg.Binary)
+	if err != nil {
+		return "", fmt.Errorf("failed to get version of %v: %w", ctx.cfg.Binary, err)
+	}
+	if versionFile != "" {
+		if err := osutil.MkdirAll(ctx.cfg.CacheDir); err != nil {
+			return "", err
+		}
+		if err := osutil.WriteFile(versionFile, []byte(version+"\n")); err != nil {
+			return "", err
+		}
+	}
+	return version, nil
+}
+
+type context struct {
+	cfg       *Config
+	extractor *subsystem.Extractor // nil if Config.NoSubsystems is set
+	// The syscall maps are set once syscallMapErr is received (see waitSyscallMap).
+	syscallNameMap map[string][]string
+	compatNameMap  map[string][]string      // set only if compat syscalls are requested
+	syscallDescs   map[string][]syscallDesc // table entries the syscall maps are built from
+	syscallMapErr  chan error
+	skipSyscalls   map[string]bool
+	interfaces     map[string]Interface
+	nodes          []ast.Node
+	timings        []FileTiming
+	emptyFiles     []string
+	warnings       int
+	warningsMu     sync.Mutex
+	version        string           // recorded in the header of the generated descriptions
+	existing       *ast.Description // all descriptions for the target OS as present on disk
+	manual         *ast.Description // existing descriptions except for AutoFile
+	// Source files for each node (keyed by serialized node) if provenance is requested.
+	nodeFiles  map[string][]string
+	provenance map[ast.Node][]string
+	// Starts of nodes of each file in nodes if Config.RawFile is set.
+	rawFiles []rawFile
+	// Netlink family for each netlink command (the identifying const of NETLINK interfaces).
+	netlinkFamilies map[string]string
+	// Files for each include that is outside of the kernel source and build dirs.
+	outsideIncludes map[string][]string
+}
+
+type output struct {
+	file     string
+	database string
+	output   []byte
+	err      error
+	duration time.Duration
+}
+
+func (ctx *context) processFiles() error {
+	cmds := ctx.cfg.CompileCommands
+	cached := 0
+	for _, cmd := range cmds {
+		if ctx.cfg.UseCache && osutil.IsExist(ctx.cacheFile(cmd)) {
+			cached++
+		}
+	}
+	if cached != 0 {
+		ctx.logger().Info(fmt.Sprintf("using cached outputs for %v/%v files", cached, len(cmds)),
+			"phase", "extract")
+	}
+
+	// Channels are bounded by the number of workers, so that outputs don't pile up in memory
+	// if we are slower at processing them than the workers. The context is canceled when we return,
+	// so that the feeder stops, and workers kill the running binaries and drain the remaining files.
+	// We wait for the workers to exit, so that no processes outlive an aborted extraction.
+	parent := ctx.cfg.Context
+	if parent == nil {
+		parent = gocontext.Background()
+	}
+	runCtx, cancel := gocontext.WithCancel(parent)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+	workers := ctx.concurrency()
+	outputs := make(chan *output, workers)
+	files := make(chan CompileCommand, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx.worker(runCtx, outputs, files)
+		}()
+	}
+	go func() {
+		defer close(files)
+		for _, cmd := range cmds {
+			select {
+			case files <- cmd:
+			case <-runCtx.Done():
+				return
+			}
+		}
+	}()
+
+	// Results for each processed file (true if succeeded) to update the list of failing files.
+	results := make(map[FailingFile]bool)
+	defer ctx.updateFailingFiles(results)
+	interrupted := false
+	for range cmds {
+		var out *output
+		select {
+		case out = <-outputs:
+		case <-runCtx.Done():
+			return runCtx.Err()
+		}
+		if out == nil {
+			continue
+		}
+		// Wait for all in-flight files to be cached, but don't process the outputs.
+		if interrupted || errors.Is(out.err, ErrInterrupted) {
+			interrupted = true
+			continue
+		}
+		failing := FailingFile{Database: out.database, File: out.file}
+		file, ok := ctx.sourcePath(out.file)
+		if !ok {
+			ctx.logger().Warn("file is outside of the kernel source and build dirs",
+				"phase", "extract", "file", out.file)
+		}
+		if out.err != nil {
+			var toolErr *ToolError
+			if errors.As(out.err, &toolErr) {
+				results[failing] = false
+			}
+			return fmt.Errorf("%v: %w", file, out.err)
+		}
+		nodes, err := ctx.parseOutput(file, out.output)
+		if err != nil {
+			results[failing] = false
+			return err
+		}
+		results[failing] = true
+		if err := ctx.waitSyscallMap(); err != nil {
+			return err
+		}
+		if !slices.ContainsFunc(nodes, func(node ast.Node) bool {
+			_, ok := node.(*ast.NewLine)
+			return !ok
+		}) {
+			ctx.emptyFiles = append(ctx.emptyFiles, file)
+		}
+		if err := ctx.appendNodes(nodes, file); err != nil {
+			return fmt.Errorf("%v: %w", file, err)
+		}
+		ctx.timings = append(ctx.timings, FileTiming{file, out.duration})
+	}
+	if interrupted {
+		return ErrInterrupted
+	}
+	slices.Sort(ctx.emptyFiles)
+	return nil
+}
+
+// waitSyscallMap waits until the syscall maps are read (if they are read concurrently),
+// the maps must not be used before it returns.
+func (ctx *context) waitSyscallMap() error {
+	if ctx.syscallMapErr == nil {
+		return nil
+	}
+	err := <-ctx.syscallMapErr
+	ctx.syscallMapErr = nil
+	return err
+}
+
+// parseOutput parses the binary output for the file. All diagnostics are reported as warnings
+// (so that they fail the run in the strict mode), even if the output is still parsed successfully.
+// Positions in diagnostics refer to the output as the synthetic file <file>.auto.
+func (ctx *context) parseOutput(file string, output []byte) ([]ast.Node, error) {
+	var firstPos ast.Pos
+	firstMsg := ""
+	eh := func(pos ast.Pos, msg string) {
+		if firstMsg == "" {
+			firstPos, firstMsg = pos, msg
+		}
+		ctx.warnf("parse", file, "%v: %v", pos, msg)
+	}
+	parse := ast.Parse(output, file+".auto", eh)
+	if parse == nil {
+		return nil, fmt.Errorf("%v: parsing error: %v: %v\n%s", file, firstPos, firstMsg,
+			outputLine(output, firstPos.Line))
+	}
+	return parse.Nodes, nil
+}
+
+// outputLine returns the line of the output with the 1-based number.
+func outputLine(output []byte, line int) []byte {
+	lines := bytes.Split(output, []byte("\n"))
+	if line < 1 || line > len(lines) {
+		return nil
+	}
+	return lines[line-1]
+}
+
+func (ctx *context) worker(runCtx gocontext.Context, outputs chan *output, files chan CompileCommand) {
+	for cmd := range files {
+		out := ctx.processFile(runCtx, cmd)
+		out.database = cmd.Database
+		select {
+		case outputs <- out:
+		case <-runCtx.Done():
+		}
+	}
+}
+
+func (ctx *context) processFile(runCtx gocontext.Context, cmd CompileCommand) *output {
+	file := cmd.File
+	if err := runCtx.Err(); err != nil {
+		return &output{file: file, err: err}
+	}
+	select {
+	case <-ctx.cfg.Shutdown:
+		return &output{file: file, err: ErrInterrupted}
+	default:
+	}
+	cacheFile := ctx.cacheFile(cmd)
+	if (ctx.cfg.UseCache || ctx.cfg.CacheOnly) && cacheFile != "" {
+		out, err := os.ReadFile(cacheFile)
+		if err == nil {
+			return &output{file: file, output: out}
+		}
+	}
+	if ctx.cfg.CacheOnly {
+		return &output{file: file, err: fmt.Errorf("no cached output in %v", ctx.cfg.CacheDir)}
+	}
+	start := time.Now()
+	out, err := ctx.runTool(runCtx, file, cmd.Database)
+	duration := time.Since(start)
+	if err == nil && cacheFile != "" {
+		writeCacheFile(cacheFile, out)
+	}
+	return &output{file: file, output: out, err: err, duration: duration}
+}
+
+func (ctx *context) cacheFile(cmd CompileCommand) string {
+	if ctx.cfg.CacheDir == "" {
+		return ""
+	}
+	dir := ctx.cfg.CacheDir
+	if cmd.Database != "" && cmd.Database != ctx.cfg.CompilationDatabase {
+		// The same file is extracted differently for other builds.
+		dir = filepath.Join(dir, "builds", hash.String([]byte(cmd.Database)))
+	}
+	if ctx.cfg.Compat {
+		// The binary emits compat syscalls only if asked to.
+		dir = filepath.Join(dir, "compat")
+	}
+	file := filepath.Clean(cmd.File)
+	for _, prefix := range append([]string{ctx.cfg.KernelSrc, ctx.cfg.KernelObj}, ctx.cfg.ExtraKernelObj...) {
+		file = strings.TrimPrefix(file, prefix)
+	}
+	return filepath.Join(dir, file)
+}
+
+// writeCacheFile writes the file atomically, so that an interrupted run never leaves a partial output
+// that would be used on resume.
+func writeCacheFile(file string, data []byte) error {
+	if err := osutil.MkdirAll(filepath.Dir(file)); err != nil {
+		return err
+	}
+	tmpFile := file + ".tmp"
+	if err := osutil.WriteFile(tmpFile, data); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, file)
+}
+
+// runTool runs the binary on the file from the compilation database (Config.CompilationDatabase if empty).
+func (ctx *context) runTool(runCtx gocontext.Context, file, database string) ([]byte, error) {
+	if database == "" {
+		database = ctx.cfg.CompilationDatabase
+	}
+	args := []string{"-p", database, file}
+	if ctx.cfg.Compat {
+		args = append(args, "--compat")
+	}
+	for _, arg := range ctx.cfg.ClangArgs {
+		args = append(args, "--extra-arg="+arg)
+	}
+	for attempt := 1; ; attempt++ {
+		// The binary runs in a separate process group, so that it does not receive SIGINT
+		// and in-flight files can be finished and cached on shutdown.
+		out, err := ctx.runBinary(osutil.CommandContext(runCtx, ctx.cfg.Binary, args...))
+		if err == nil {
+			return out, nil
+		}
+		if runCtx.Err() != nil {
+			// The binary was killed b/c extraction is aborted.
+			return nil, runCtx.Err()
+		}
+		toolErr := &ToolError{
+			File: file,
+			Kind: ToolNotRun,
+			Err:  err,
+		}
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			toolErr.Kind = ToolFailed
+			// ExitCode returns -1 if the process was killed by a signal.
+			if toolErr.ExitCode = exitErr.ExitCode(); toolErr.ExitCode == -1 {
+				toolErr.Kind = ToolKilled
+			}
+			toolErr.Stderr = exitErr.Stderr
+			if ctx.cfg.MemLimit != 0 && outOfMemory(toolErr.Stderr) {
+				toolErr.Kind = ToolMemLimit
+				toolErr.Err = fmt.Errorf("exceeded memory limit of %v MB: %w", ctx.cfg.MemLimit>>20, err)
+			}
+		}
+		if attempt > ctx.cfg.Retries || !isTransientFailure(toolErr, out) {
+			return nil, toolErr
+		}
+		ctx.logger().Info(fmt.Sprintf("%v, retrying (attempt %v/%v)", toolErr.Err, attempt, ctx.cfg.Retries),
+			"phase", "extract", "file", file)
+		select {
+		case <-time.After(time.Duration(attempt) * time.Second):
+		case <-runCtx.Done():
+			return nil, runCtx.Err()
+		}
+	}
+}
+
+// runBinary runs the command like cmd.Output, and applies Config.MemLimit to the process if set
+// (the limit is set right after the process is started, before it has time to allocate much memory).
+func (ctx *context) runBinary(cmd *exec.Cmd) ([]byte, error) {
+	if ctx.cfg.MemLimit == 0 {
+		return cmd.Output()
+	}
+	stdout, stderr := new(bytes.Buffer), new(bytes.Buffer)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	if err := setMemLimit(cmd.Process.Pid, ctx.cfg.MemLimit); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("failed to set memory limit: %w", err)
+	}
+	err := cmd.Wait()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitErr.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
+
+// outOfMemory says if the binary failed to allocate memory (failed allocations abort LLVM tools).
+func outOfMemory(stderr []byte) bool {
+	return bytes.Contains(stderr, []byte("out of memory")) || bytes.Contains(stderr, []byte("std::bad_alloc"))
+}
+
+// isTransientFailure says if the tool failed for reasons not related to the file itself
+// (e.g. it was OOM-killed), and thus it makes sense to retry. Parsing errors are not transient,
+// the tool always prints something in that case.
+func isTransientFailure(err *ToolError, stdout []byte) bool {
+	return err.Kind == ToolKilled || err.Kind == ToolFailed && len(stdout) == 0 && len(err.Stderr) == 0
+}
+
+// ToolError is returned by Extract (wrapped) if the binary failed on a file.
+type ToolError struct {
+	File     string
+	Kind     ToolErrorKind
+	ExitCode int // -1 if the binary was killed by a signal, 0 if it was not run
+	Stderr   []byte
+	Err      error
+}
+
+type ToolErrorKind int
+
+const (
+	ToolNotRun   ToolErrorKind = iota // the binary failed to start (e.g. it does not exist)
+	ToolFailed                        // the binary exited with a non-zero exit code
+	ToolKilled                        // the binary was killed by a signal (e.g. by the OOM killer)
+	ToolMemLimit                      // the binary ran out of memory with Config.MemLimit
+)
+
+func (kind ToolErrorKind) String() string {
+	switch kind {
+	case ToolNotRun:
+		return "failed to run"
+	case ToolFailed:
+		return "failed"
+	case ToolKilled:
+		return "killed"
+	case ToolMemLimit:
+		return "exceeded memory limit"
+	}
+	return fmt.Sprintf("ToolErrorKind(%d)", int(kind))
+}
+
+func (err *ToolError) Error() string {
+	if len(err.Stderr) != 0 && err.Kind != ToolMemLimit {
+		return string(err.Stderr)
+	}
+	return err.Err.Error()
+}
+
+func (err *ToolError) Unwrap() error {
+	return err.Err
+}
+
+func (ctx *context) appendNodes(nodes []ast.Node, file string) error {
+	if ctx.cfg != nil && ctx.cfg.RawFile != "" {
+		ctx.rawFiles = append(ctx.rawFiles, rawFile{file: file, start: len(ctx.nodes)})
+	}
+	for _, node := range nodes {
+		switch node := node.(type) {
+		case *ast.Call:
+			ctx.recordNetlinkCommand(node, file)
+			// Some syscalls have different names and entry points and thus need to be renamed.
+			// e.g. SYSCALL_DEFINE1(setuid16, old_uid_t, uid) is referred to in the .tbl file with setuid.
+			ctx.addNodes(file, ctx.renameSyscall(node, file)...)
+		case *ast.Include:
+			if inc, ok := ctx.sourcePath(node.File.Value); ok {
+				node.File.Value = inc
+			} else {
+				ctx.logger().Warn(fmt.Sprintf("include %v is outside of the kernel source and build dirs",
+					node.File.Value), "phase", "parse", "file", file)
+				if ctx.outsideIncludes == nil {
+					ctx.outsideIncludes = make(map[string][]string)
+				}
+				ctx.outsideIncludes[node.File.Value] = append(ctx.outsideIncludes[node.File.Value], file)
+			}
+			if replace := includeReplaces[node.File.Value]; replace != "" {
+				node.File.Value = replace
+			}
+			ctx.addNodes(file, node)
+		case *ast.Comment:
+			if !strings.HasPrefix(node.Text, "INTERFACE:") {
+				ctx.addNodes(file, node)
+				continue
+			}
+			if err := ctx.appendInterface(node, file); err != nil {
+				return err
+			}
+		default:
+			if getTypeOrder(node) == unknownTypeOrder {
+				pos, _, _ := node.Info()
+				ctx.warnf("parse", file, "unhandled node type %T at %v", node, pos)
+			}
+			ctx.addNodes(file, node)
+		}
+	}
+	return nil
+}
+
+func (ctx *context) appendInterface(node *ast.Comment, file string) error {
+	fields := strings.Fields(node.Text)
+	if len(fields) != 6 {
+		return fmt.Errorf("%q has wrong number of fields", node.Text)
+	}
+	for i := range fields {
+		if fields[i] == "-" {
+			fields[i] = ""
+		}
+	}
+	iface := Interface{
+		Type:             fields[1],
+		Name:             fields[2],
+		Files:            []string{file},
+		identifyingConst: fields[3],
+		Func:             fields[4],
+		Access:           fields[5],
+	}
+	if iface.Type != "SYSCALL" {
+		return ctx.mergeInterface(iface)
+	}
+	names := ctx.syscallNameMap[iface.Name]
+	if len(names) == 0 && !ctx.skipSyscalls[iface.Name] {
+		ctx.warnf("parse", file, "syscall %v is not present in the syscall tables", iface.Name)
+	}
+	for _, name := range names {
+		iface.Name = name
+		iface.identifyingConst = "__NR_" + name
+		if err := ctx.mergeInterface(iface); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warnf logs a problem found in the extracted data, file may be empty if the problem is not related to a file.
+func (ctx *context) warnf(phase, file, msg string, args ...any) {
+	// Syscall tables are read concurrently with processing of the outputs.
+	ctx.warningsMu.Lock()
+	ctx.warnings++
+	ctx.warningsMu.Unlock()
+	attrs := []any{"phase", phase}
+	if file != "" {
+		attrs = append(attrs, "file", file)
+	}
+	ctx.logger().Warn(fmt.Sprintf(msg, args...), attrs...)
+}
+
+func (ctx *context) logger() *slog.Logger {
+	if ctx.cfg == nil || ctx.cfg.Logger == nil {
+		return slog.Default()
+	}
+	return ctx.cfg.Logger
+}
+
+func (ctx *context) concurrency() int {
+	if ctx.cfg == nil || ctx.cfg.Concurrency <= 0 {
+		return runtime.NumCPU()
+	}
+	return ctx.cfg.Concurrency
+}
+
+// errorHandler returns ast.ErrorHandler that reports description errors to the logger.
+func (ctx *context) errorHandler(phase string) ast.ErrorHandler {
+	return func(pos ast.Pos, msg string) {
+		ctx.logger().Error(msg, "phase", phase, "pos", pos.String())
+	}
+}
+
+func (ctx *context) addNodes(file string, nodes ...ast.Node) {
+	ctx.nodes = append(ctx.nodes, nodes...)
+	if ctx.nodeFiles == nil {
+		return
+	}
+	for _, node := range nodes {
+		key := ast.SerializeNode(node)
+		ctx.nodeFiles[key] = append(ctx.nodeFiles[key], file)
+	}
+}
+
+// sourcePath returns path of the file relative to the module source dir for module files,
+// or relative to the kernel source/build dirs otherwise (see RelativePath).
+func (ctx *context) sourcePath(file string) (string, bool) {
+	if ctx.cfg.ModuleSrc != "" && filepath.IsAbs(file) {
+		if rel, ok := RelativePath(ctx.cfg.ModuleSrc, ctx.cfg.ModuleSrc, file); ok {
+			return rel, true
+		}
+	}
+	res, ok := RelativePath(ctx.cfg.KernelSrc, ctx.cfg.KernelObj, file)
+	if ok || !filepath.IsAbs(file) {
+		return res, ok
+	}
+	for _, obj := range ctx.cfg.ExtraKernelObj {
+		if rel, ok := RelativePath(ctx.cfg.KernelSrc, obj, file); ok {
+			return rel, true
+		}
+	}
+	return res, false
+}
+
+// RelativePath converts the file path (absolute or relative to the build dir) to a path relative
+// to the kernel source dir, or relative to the build dir for generated files in out-of-tree builds.
+// Includes relative to either of these dirs resolve from the descriptions.
+// Symlinks are resolved if the file is not inside of the dirs literally (the dirs may be symlinks,
+// while the compilation database refers to resolved paths, or vice versa).
+// Returns false if the file is outside of both dirs.
+func RelativePath(sourceDir, buildDir, file string) (string, bool) {
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(buildDir, file)
+	}
+	if rel, ok := relativePath(sourceDir, buildDir, file); ok {
+		return rel, true
+	}
+	if rel, ok := relativePath(evalSymlinks(sourceDir), evalSymlinks(buildDir), evalSymlinks(file)); ok {
+		return rel, true
+	}
+	return file, false
+}
+
+func relativePath(sourceDir, buildDir, file string) (string, bool) {
+	for _, dir := range []string{sourceDir, buildDir} {
+		rel, err := filepath.Rel(dir, file)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return rel, true
+		}
+	}
+	return "", false
+}
+
+// evalSymlinks returns the resolved path, or the path itself if it can't be resolved.
+func evalSymlinks(path string) string {
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved
+	}
+	return path
+}
+
+// Replace these includes in the tool output.
+var includeReplaces = map[string]string{
+	// Arches may use some includes from asm-generic and some from arch/arm.
+	// If the arch used for extract used asm-generic for a header,
+	// other arches may need arch/asm version of the header. So switch to
+	// a more generic file name that should resolve correctly for all arches.
+	"include/uapi/asm-generic/ioctls.h":  "asm/ioctls.h",
+	"include/uapi/asm-generic/sockios.h": "asm/sockios.h",
+}
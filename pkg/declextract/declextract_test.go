@@ -0,0 +1,452 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"bytes"
+	gocontext "context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/syzkaller/pkg/ast"
+	"github.com/google/syzkaller/pkg/osutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRelativePath(t *testing.T) {
+	type Test struct {
+		src  string
+		obj  string
+		file string
+		res  string
+		ok   bool
+	}
+	tests := []Test{
+		{"/linux", "/linux", "include/uapi/linux/fs.h", "include/uapi/linux/fs.h", true},
+		{"/linux", "/linux", "/linux/fs/read_write.c", "fs/read_write.c", true},
+		{"/src/linux", "/build/linux", "../../src/linux/include/uapi/linux/fs.h", "include/uapi/linux/fs.h", true},
+		{"/src/linux", "/build/linux", "/src/linux/fs/read_write.c", "fs/read_write.c", true},
+		{"/src/linux", "/build/linux", "include/generated/uapi/linux/version.h",
+			"include/generated/uapi/linux/version.h", true},
+		{"/src/linux", "/build/linux", "/build/linux/include/generated/autoconf.h", "include/generated/autoconf.h", true},
+		{"/src/linux", "/build/linux", "/usr/include/stdio.h", "/usr/include/stdio.h", false},
+		{"/src/linux", "/build/linux", "../../usr/include/stdio.h", "/usr/include/stdio.h", false},
+		{"/src/linux", "/build/linux", "/src/linux..bak/fs.h", "/src/linux..bak/fs.h", false},
+	}
+	for _, test := range tests {
+		res, ok := RelativePath(test.src, test.obj, test.file)
+		assert.Equal(t, test.ok, ok, "file: %v", test.file)
+		assert.Equal(t, test.res, res, "file: %v", test.file)
+	}
+}
+
+func TestRelativePathSymlinks(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src", "linux")
+	link := filepath.Join(dir, "linux")
+	file := filepath.Join(src, "fs", "read_write.c")
+	if err := osutil.MkdirAll(filepath.Dir(file)); err != nil {
+		t.Fatal(err)
+	}
+	if err := osutil.WriteFile(file, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(src, link); err != nil {
+		t.Fatal(err)
+	}
+	// Source dir is a symlink, but the file path is resolved.
+	res, ok := RelativePath(link, link, file)
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join("fs", "read_write.c"), res)
+	// Source dir is resolved, but the file path goes through the symlink.
+	res, ok = RelativePath(src, src, filepath.Join(link, "fs", "read_write.c"))
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join("fs", "read_write.c"), res)
+	// Relative paths are resolved against the symlinked build dir.
+	res, ok = RelativePath(src, link, filepath.Join("fs", "read_write.c"))
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join("fs", "read_write.c"), res)
+	_, ok = RelativePath(link, link, filepath.Join(dir, "other.c"))
+	assert.False(t, ok)
+}
+
+func TestUnmappedSyscall(t *testing.T) {
+	dir := t.TempDir()
+	writeSyscallTable(t, dir, "x86", `
+0	common	read	sys_read
+`)
+	syscallNameMap, _, err := (&context{cfg: &Config{KernelSrc: dir}}).readSyscallMap(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &context{
+		syscallNameMap: syscallNameMap,
+		interfaces:     make(map[string]Interface),
+	}
+	mustAppendNodes(t, ctx, parseNodes(t, `
+#INTERFACE: SYSCALL read __NR_read ksys_read user
+#INTERFACE: SYSCALL foo __NR_foo __do_sys_foo user
+`), "fs/read_write.c")
+	assert.Equal(t, 1, ctx.warnings)
+	assert.Len(t, ctx.interfaces, 1)
+	assert.Contains(t, ctx.interfaces, "SYSCALL/read")
+}
+
+func writeSyscallTable(t *testing.T, dir, arch, data string) {
+	file := filepath.Join(dir, "arch", arch, "entry", "syscalls", "syscall_64.tbl")
+	if err := osutil.MkdirAll(filepath.Dir(file)); err != nil {
+		t.Fatal(err)
+	}
+	if err := osutil.WriteFile(file, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func parseNodes(t *testing.T, data string) []ast.Node {
+	desc := ast.Parse([]byte(data), "", nil)
+	if desc == nil {
+		t.Fatalf("failed to parse:\n%s", data)
+	}
+	return desc.Nodes
+}
+
+func callNames(nodes []ast.Node) []string {
+	var names []string
+	for _, node := range nodes {
+		if call, ok := node.(*ast.Call); ok {
+			names = append(names, call.Name.Name)
+		}
+	}
+	return names
+}
+
+func mustAppendNodes(t *testing.T, ctx *context, nodes []ast.Node, file string) {
+	if err := ctx.appendNodes(nodes, file); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCacheOnly(t *testing.T) {
+	cacheDir := t.TempDir()
+	if err := osutil.MkdirAll(filepath.Join(cacheDir, "fs")); err != nil {
+		t.Fatal(err)
+	}
+	if err := osutil.WriteFile(filepath.Join(cacheDir, "fs", "read_write.c"), []byte("read(fd fd)\n")); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &context{
+		cfg: &Config{
+			Binary:    "/nonexistent/syz-declextract",
+			KernelSrc: "/linux",
+			KernelObj: "/linux",
+			CacheDir:  cacheDir,
+			CacheOnly: true,
+		},
+	}
+	outputs := make(chan *output, 2)
+	files := make(chan CompileCommand, 2)
+	files <- CompileCommand{File: "/linux/fs/read_write.c"}
+	files <- CompileCommand{File: "/linux/fs/open.c"}
+	close(files)
+	ctx.worker(gocontext.Background(), outputs, files)
+	out := <-outputs
+	assert.NoError(t, out.err)
+	assert.Equal(t, "read(fd fd)\n", string(out.output))
+	out = <-outputs
+	assert.Error(t, out.err)
+	version, err := ctx.binaryVersion()
+	assert.NoError(t, err)
+	assert.Empty(t, version)
+	assert.Equal(t, 1, ctx.warnings)
+}
+
+func TestShutdown(t *testing.T) {
+	cacheDir := t.TempDir()
+	shutdown := make(chan struct{})
+	close(shutdown)
+	ctx := &context{
+		cfg: &Config{
+			Binary:          "/nonexistent/syz-declextract",
+			KernelSrc:       "/linux",
+			KernelObj:       "/linux",
+			CacheDir:        cacheDir,
+			UseCache:        true,
+			Shutdown:        shutdown,
+			CompileCommands: []CompileCommand{{File: "/linux/fs/read_write.c"}, {File: "/linux/fs/open.c"}},
+		},
+	}
+	assert.ErrorIs(t, ctx.processFiles(), ErrInterrupted)
+}
+
+func TestProcessFilesError(t *testing.T) {
+	// The number of files is much larger than the channel buffers,
+	// returning on the first error must not deadlock.
+	var cmds []CompileCommand
+	for i := 0; i < 1000; i++ {
+		cmds = append(cmds, CompileCommand{File: fmt.Sprintf("/linux/fs/file%v.c", i)})
+	}
+	ctx := &context{
+		cfg: &Config{
+			Binary:          "/nonexistent/syz-declextract",
+			KernelSrc:       "/linux",
+			KernelObj:       "/linux",
+			CacheDir:        t.TempDir(),
+			CacheOnly:       true,
+			CompileCommands: cmds,
+		},
+	}
+	assert.ErrorContains(t, ctx.processFiles(), "no cached output")
+}
+
+func TestWriteCacheFile(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "fs", "read_write.c")
+	assert.NoError(t, writeCacheFile(file, []byte("read(fd fd)\n")))
+	data, err := os.ReadFile(file)
+	assert.NoError(t, err)
+	assert.Equal(t, "read(fd fd)\n", string(data))
+	assert.False(t, osutil.IsExist(file+".tmp"))
+}
+
+func TestParseOutput(t *testing.T) {
+	ctx := &context{}
+	nodes, err := ctx.parseOutput("fs/read_write.c", []byte("read(fd fd)\n"))
+	assert.NoError(t, err)
+	assert.Len(t, nodes, 1)
+	assert.Equal(t, 0, ctx.warnings)
+	_, err = ctx.parseOutput("fs/read_write.c", []byte("read(fd fd)\nwrite(fd fd\n"))
+	assert.ErrorContains(t, err, "fs/read_write.c.auto:2:")
+	assert.ErrorContains(t, err, "\nwrite(fd fd")
+	assert.NotZero(t, ctx.warnings)
+}
+
+func TestModuleSourcePath(t *testing.T) {
+	ctx := &context{
+		cfg: &Config{
+			KernelSrc: "/linux",
+			KernelObj: "/build",
+			ModuleSrc: "/src/mymodule",
+		},
+	}
+	for file, want := range map[string]string{
+		"/src/mymodule/main.c":         "main.c",
+		"/src/mymodule/include/uapi.h": "include/uapi.h",
+		"/linux/include/linux/fs.h":    "include/linux/fs.h",
+		"/build/include/config.h":      "include/config.h",
+	} {
+		got, ok := ctx.sourcePath(file)
+		assert.True(t, ok, file)
+		assert.Equal(t, want, got, file)
+	}
+	_, ok := ctx.sourcePath("/src/other/main.c")
+	assert.False(t, ok)
+}
+
+func TestMemLimit(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("memory limit is supported only on linux")
+	}
+	// The limit is set after the process is started, so wait for it to be applied.
+	binary := filepath.Join(t.TempDir(), "oom.sh")
+	if err := osutil.WriteExecFile(binary, []byte(`#!/bin/sh
+for i in $(seq 500); do [ "$(ulimit -v)" != unlimited ] && break; sleep 0.01; done
+echo "LLVM ERROR: out of memory (limit $(ulimit -v))" >&2
+exit 1
+`)); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &context{cfg: &Config{Binary: binary, MemLimit: 1 << 30}}
+	_, err := ctx.runTool(gocontext.Background(), "fs/read_write.c", "")
+	var toolErr *ToolError
+	if !errors.As(err, &toolErr) {
+		t.Fatalf("got %v, want ToolError", err)
+	}
+	assert.Equal(t, ToolMemLimit, toolErr.Kind)
+	assert.Contains(t, string(toolErr.Stderr), "(limit 1048576)")
+	assert.ErrorContains(t, err, "exceeded memory limit of 1024 MB")
+}
+
+func TestOutsideIncludes(t *testing.T) {
+	logs := new(bytes.Buffer)
+	ctx := &context{
+		cfg: &Config{
+			KernelSrc: "/linux",
+			KernelObj: "/build",
+			Logger:    slog.New(slog.NewTextHandler(logs, nil)),
+		},
+	}
+	for _, file := range []string{"fs/b.c", "fs/a.c", "fs/a.c"} {
+		mustAppendNodes(t, ctx, parseNodes(t, `
+include </usr/include/stdio.h>
+include </linux/include/linux/fs.h>
+`), file)
+	}
+	mustAppendNodes(t, ctx, parseNodes(t, "include </opt/foo.h>\n"), "fs/c.c")
+	logs.Reset()
+	ctx.reportOutsideIncludes()
+	assert.Contains(t, logs.String(), `msg="2 includes are outside of the kernel source and build dirs:`+
+		` /opt/foo.h (fs/c.c), /usr/include/stdio.h (fs/a.c, fs/b.c)"`)
+	assert.Equal(t, 0, ctx.warnings)
+}
+
+func TestToolError(t *testing.T) {
+	dir := t.TempDir()
+	killed := filepath.Join(dir, "killed.sh")
+	if err := osutil.WriteExecFile(killed, []byte("#!/bin/sh\nkill -9 $$\n")); err != nil {
+		t.Fatal(err)
+	}
+	failed := filepath.Join(dir, "failed.sh")
+	if err := osutil.WriteExecFile(failed, []byte("#!/bin/sh\necho parsing error >&2\nexit 2\n")); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		binary   string
+		kind     ToolErrorKind
+		exitCode int
+	}{
+		{filepath.Join(dir, "nonexistent"), ToolNotRun, 0},
+		{killed, ToolKilled, -1},
+		{failed, ToolFailed, 2},
+	} {
+		ctx := &context{cfg: &Config{Binary: test.binary}}
+		_, err := ctx.runTool(gocontext.Background(), "fs/read_write.c", "")
+		var toolErr *ToolError
+		if !errors.As(err, &toolErr) {
+			t.Fatalf("%v: got %v, want ToolError", test.binary, err)
+		}
+		assert.Equal(t, test.kind, toolErr.Kind, test.binary)
+		assert.Equal(t, test.exitCode, toolErr.ExitCode, test.binary)
+		assert.Equal(t, "fs/read_write.c", toolErr.File)
+	}
+}
+
+func TestEmptyFiles(t *testing.T) {
+	cacheDir := t.TempDir()
+	for file, data := range map[string]string{
+		"fs/read_write.c": "read(fd fd)\n",
+		"fs/open.c":       "\n\n",
+		"fs/stat.c":       "",
+	} {
+		if err := writeCacheFile(filepath.Join(cacheDir, file), []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := &context{
+		cfg: &Config{
+			KernelSrc: "/linux",
+			KernelObj: "/linux",
+			CacheDir:  cacheDir,
+			CacheOnly: true,
+			CompileCommands: []CompileCommand{
+				{File: "/linux/fs/stat.c"},
+				{File: "/linux/fs/read_write.c"},
+				{File: "/linux/fs/open.c"},
+			},
+		},
+		syscallNameMap: map[string][]string{"read": {"read"}},
+	}
+	if err := ctx.processFiles(); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"fs/open.c", "fs/stat.c"}, ctx.emptyFiles)
+}
+
+func TestNodeTransform(t *testing.T) {
+	dir := t.TempDir()
+	writeSyscallTable(t, dir, "x86", "0\tcommon\tread\tsys_read\n1\tcommon\twrite\tsys_write\n")
+	sysDir := filepath.Join(dir, "sys", "linux")
+	if err := osutil.MkdirAll(sysDir); err != nil {
+		t.Fatal(err)
+	}
+	if err := osutil.WriteFile(filepath.Join(sysDir, "sys.txt"), []byte("resource fd[int32]\n")); err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := t.TempDir()
+	if err := writeCacheFile(filepath.Join(cacheDir, "fs", "read_write.c"),
+		[]byte("read(fd fd)\nwrite(fd fd)\n")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := Extract(&Config{
+		KernelSrc:       dir,
+		KernelObj:       dir,
+		CacheDir:        cacheDir,
+		CacheOnly:       true,
+		CompileCommands: []CompileCommand{{File: filepath.Join(dir, "fs", "read_write.c")}},
+		AutoFile:        filepath.Join(sysDir, "auto.txt"),
+		NodeTransform: func(nodes []ast.Node) []ast.Node {
+			return slices.DeleteFunc(nodes, func(node ast.Node) bool {
+				call, ok := node.(*ast.Call)
+				return ok && call.CallName == "write"
+			})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"read$auto"}, callNames(res.Descriptions.Nodes))
+}
+
+func TestExtraKernelObj(t *testing.T) {
+	ctx := &context{
+		cfg: &Config{
+			KernelSrc:           "/linux",
+			KernelObj:           "/build/defconfig",
+			ExtraKernelObj:      []string{"/build/allmodconfig"},
+			CompilationDatabase: "/build/defconfig/compile_commands.json",
+			CacheDir:            "/cache",
+		},
+	}
+	for file, want := range map[string]string{
+		"/linux/fs/read_write.c":                  "fs/read_write.c",
+		"/build/defconfig/include/generated.h":    "include/generated.h",
+		"/build/allmodconfig/include/generated.h": "include/generated.h",
+	} {
+		got, ok := ctx.sourcePath(file)
+		assert.True(t, ok, file)
+		assert.Equal(t, want, got, file)
+	}
+	primary := ctx.cacheFile(CompileCommand{
+		File:     "/linux/fs/read_write.c",
+		Database: "/build/defconfig/compile_commands.json",
+	})
+	assert.Equal(t, "/cache/fs/read_write.c", primary)
+	extra := ctx.cacheFile(CompileCommand{
+		File:     "/linux/fs/read_write.c",
+		Database: "/build/allmodconfig/compile_commands.json",
+	})
+	assert.NotEqual(t, primary, extra)
+	assert.True(t, strings.HasSuffix(extra, "/fs/read_write.c"), extra)
+}
+
+func TestAbort(t *testing.T) {
+	binary := filepath.Join(t.TempDir(), "syz-declextract")
+	if err := osutil.WriteExecFile(binary, []byte("#!/bin/sh\nexec sleep 1000\n")); err != nil {
+		t.Fatal(err)
+	}
+	abortCtx, cancel := gocontext.WithTimeout(gocontext.Background(), 100*time.Millisecond)
+	defer cancel()
+	ctx := &context{
+		cfg: &Config{
+			Binary:    binary,
+			KernelSrc: "/linux",
+			KernelObj: "/linux",
+			CompileCommands: []CompileCommand{
+				{File: "/linux/fs/read_write.c"},
+				{File: "/linux/fs/open.c"},
+			},
+			Context: abortCtx,
+		},
+	}
+	start := time.Now()
+	err := ctx.processFiles()
+	assert.ErrorIs(t, err, gocontext.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Minute)
+}
@@ -0,0 +1,860 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/syzkaller/pkg/ast"
+	"github.com/google/syzkaller/pkg/compiler"
+	"github.com/google/syzkaller/pkg/hash"
+	"github.com/google/syzkaller/pkg/osutil"
+	"github.com/google/syzkaller/prog"
+	"github.com/google/syzkaller/sys/targets"
+)
+
+// FormatDescriptions returns the final serialized form of the descriptions.
+func FormatDescriptions(desc *ast.Description) ([]byte, error) {
+	// New lines are added in the parsing step. This is why we need to Format (serialize the description),
+	// Parse, then Format again.
+	var errs []string
+	eh := func(pos ast.Pos, msg string) {
+		errs = append(errs, fmt.Sprintf("%v: %v", pos, msg))
+	}
+	formatted := ast.Parse(ast.Format(desc), "", eh)
+	if formatted == nil {
+		return nil, fmt.Errorf("failed to parse generated descriptions:\n%v", strings.Join(errs, "\n"))
+	}
+	return ast.Format(formatted), nil
+}
+
+func (ctx *context) finishDescriptions() error {
+	if ctx.cfg.WarnIncludes {
+		ctx.reportOutsideIncludes()
+	}
+	prev := ctx.cfg.PrevDescriptions
+	var prevNodes []ast.Node
+	if prev != nil {
+		prevNodes = prev.Nodes
+		if ctx.cfg.PrevProvenance != nil {
+			prevNodes = ctx.addPrevNodes(prevNodes)
+		}
+	}
+	ctx.nodes = sortNodes(ctx.nodes)
+	if ctx.nodeFiles != nil {
+		// Bind files to the deduplicated nodes before calls are renamed.
+		ctx.provenance = make(map[ast.Node][]string)
+		for _, node := range ctx.nodes {
+			files := ctx.nodeFiles[ast.SerializeNode(node)]
+			slices.Sort(files)
+			ctx.provenance[node] = slices.Compact(files)
+		}
+	}
+	if ctx.cfg.MergeStructs {
+		if err := ctx.mergeStructs(); err != nil {
+			return err
+		}
+	}
+
+	renameDuplicateCalls(ctx.nodes)
+
+	if len(prevNodes) != 0 {
+		ctx.nodes = mergeNodes(prevNodes, ctx.nodes, ctx.headerIncludes())
+	}
+	ctx.nodes = groupIncludes(headerNodes(ctx.version, ctx.headerIncludes()), ctx.nodes)
+	return nil
+}
+
+// addPrevNodes adds the previous nodes with known provenance to the extracted nodes as if they were extracted
+// from their files that were not extracted in this run, the nodes that come only from the extracted files
+// are dropped. Renamed duplicate calls get their original names back, since the set of duplicates may change.
+// Returns the previous nodes without provenance, they are merged by type and name (see mergeNodes).
+func (ctx *context) addPrevNodes(prev []ast.Node) []ast.Node {
+	extracted := make(map[string]bool)
+	for _, cmd := range ctx.cfg.CompileCommands {
+		file, _ := ctx.sourcePath(cmd.File)
+		extracted[file] = true
+	}
+	var rest []ast.Node
+	for _, node := range generatedNodes(prev, ctx.headerIncludes()) {
+		files := ctx.cfg.PrevProvenance[provenanceKey(node)]
+		if len(files) == 0 {
+			rest = append(rest, node)
+			continue
+		}
+		files = slices.DeleteFunc(slices.Clone(files), func(file string) bool {
+			return extracted[file]
+		})
+		if len(files) == 0 {
+			continue
+		}
+		node = node.Clone()
+		if call, ok := node.(*ast.Call); ok {
+			call.Name.Name = duplicateCallBase(call)
+		}
+		ctx.nodes = append(ctx.nodes, node)
+		if ctx.nodeFiles != nil {
+			key := ast.SerializeNode(node)
+			ctx.nodeFiles[key] = append(ctx.nodeFiles[key], files...)
+		}
+	}
+	return rest
+}
+
+// reportOutsideIncludes logs includes that are left as is since they are outside of the kernel dirs,
+// they are likely to not resolve from the descriptions and break compilation.
+func (ctx *context) reportOutsideIncludes() {
+	var includes []string
+	for inc := range ctx.outsideIncludes {
+		includes = append(includes, inc)
+	}
+	if len(includes) == 0 {
+		return
+	}
+	slices.Sort(includes)
+	var lines []string
+	for _, inc := range includes {
+		files := slices.Clone(ctx.outsideIncludes[inc])
+		slices.Sort(files)
+		lines = append(lines, fmt.Sprintf("%v (%v)", inc, strings.Join(slices.Compact(files), ", ")))
+	}
+	ctx.logger().Warn(fmt.Sprintf("%v includes are outside of the kernel source and build dirs: %v",
+		len(includes), strings.Join(lines, ", ")), "phase", "finish")
+}
+
+// renameDuplicateCalls gives unique names to calls with the same name (and different arguments).
+// All calls with the same name get suffixes derived from their contents (read$auto_1a2b3c4d), so that
+// adding or removing a variant does not rename the other variants. Suffixes that would give the name
+// of another call are extended, so the renamed calls never collide.
+func renameDuplicateCalls(nodes []ast.Node) {
+	names := make(map[string]bool)
+	counts := make(map[string]int)
+	for _, node := range nodes {
+		if call, ok := node.(*ast.Call); ok {
+			names[call.Name.Name] = true
+			counts[call.Name.Name]++
+		}
+	}
+	for _, node := range nodes {
+		call, ok := node.(*ast.Call)
+		if !ok || counts[call.Name.Name] < 2 {
+			continue
+		}
+		base, sig := call.Name.Name, duplicateCallSig(call, call.Name.Name)
+		n := duplicateSuffixLen
+		for ; n < len(sig) && names[base+"_"+sig[:n]]; n += 4 {
+		}
+		call.Name.Name = base + "_" + sig[:n]
+		names[call.Name.Name] = true
+	}
+}
+
+// duplicateSuffixLen is the minimal length of suffixes of duplicate calls (see renameDuplicateCalls).
+const duplicateSuffixLen = 8
+
+// duplicateCallSig returns the signature used for the suffix of the duplicate call with the name.
+func duplicateCallSig(call *ast.Call, name string) string {
+	renamed := *call
+	renamed.Name = &ast.Ident{Pos: call.Name.Pos, Name: name}
+	return hash.String([]byte(ast.SerializeNode(&renamed)))
+}
+
+// duplicateCallBase returns the name of the call before it was renamed by renameDuplicateCalls.
+func duplicateCallBase(call *ast.Call) string {
+	name := call.Name.Name
+	for i := strings.LastIndexByte(name, '_'); i > 0; i = strings.LastIndexByte(name[:i], '_') {
+		base, suffix := name[:i], name[i+1:]
+		if len(suffix) >= duplicateSuffixLen && strings.HasPrefix(duplicateCallSig(call, base), suffix) {
+			return base
+		}
+	}
+	return name
+}
+
+// groupIncludes returns the header followed by all includes sorted by path (except for the ones
+// already present in the header), and then by the rest of the nodes. Otherwise comments go between
+// the header includes and the rest of includes, and the same include may be present twice.
+func groupIncludes(header, nodes []ast.Node) []ast.Node {
+	seen := make(map[string]bool)
+	for _, node := range header {
+		if inc, ok := node.(*ast.Include); ok {
+			seen[inc.File.Value] = true
+		}
+	}
+	var includes, rest []ast.Node
+	for _, node := range nodes {
+		inc, ok := node.(*ast.Include)
+		if !ok {
+			rest = append(rest, node)
+			continue
+		}
+		if !seen[inc.File.Value] {
+			seen[inc.File.Value] = true
+			includes = append(includes, inc)
+		}
+	}
+	slices.SortFunc(includes, func(a, b ast.Node) int {
+		return strings.Compare(a.(*ast.Include).File.Value, b.(*ast.Include).File.Value)
+	})
+	return slices.Concat(header, includes, rest)
+}
+
+// canonicalizeDescriptions sorts and deduplicates values of flags (their order does not matter).
+// Alignment of fields is already consistent in ast.Format. Fields of structs and unions are never
+// reordered since their order determines the struct layout and the default union option.
+func canonicalizeDescriptions(desc *ast.Description) {
+	for _, node := range desc.Nodes {
+		switch n := node.(type) {
+		case *ast.IntFlags:
+			slices.SortStableFunc(n.Values, compareInts)
+			n.Values = slices.CompactFunc(n.Values, func(a, b *ast.Int) bool {
+				return compareInts(a, b) == 0
+			})
+		case *ast.StrFlags:
+			slices.SortStableFunc(n.Values, func(a, b *ast.String) int {
+				return strings.Compare(a.Value, b.Value)
+			})
+			n.Values = slices.CompactFunc(n.Values, func(a, b *ast.String) bool {
+				return a.Value == b.Value
+			})
+		}
+	}
+}
+
+// compareInts orders numbers before C expressions and before consts (only one of them is set).
+func compareInts(a, b *ast.Int) int {
+	if res := strings.Compare(a.Ident, b.Ident); res != 0 {
+		return res
+	}
+	if res := strings.Compare(a.CExpr, b.CExpr); res != 0 {
+		return res
+	}
+	return cmp.Compare(a.Value, b.Value)
+}
+
+// mergeStructs merges structs with the same name that differ only in the order of fields
+// (different files may emit them in different order). The definition that goes first
+// in the sorted order is kept. Structs with the same name and different fields are errors.
+func (ctx *context) mergeStructs() error {
+	structs := make(map[string][]*ast.Struct)
+	for _, node := range ctx.nodes {
+		if str, ok := node.(*ast.Struct); ok {
+			structs[nodeKey(str)] = append(structs[nodeKey(str)], str)
+		}
+	}
+	remove := make(map[ast.Node]bool)
+	for _, defs := range structs {
+		if len(defs) == 1 {
+			continue
+		}
+		canonical := canonicalStruct(defs[0])
+		for _, def := range defs[1:] {
+			if canonicalStruct(def) != canonical {
+				return fmt.Errorf("conflicting definitions of %v:\n%v%v",
+					def.Name.Name, ast.SerializeNode(defs[0]), ast.SerializeNode(def))
+			}
+			remove[def] = true
+			if ctx.provenance != nil {
+				files := slices.Concat(ctx.provenance[defs[0]], ctx.provenance[def])
+				slices.Sort(files)
+				ctx.provenance[defs[0]] = slices.Compact(files)
+			}
+		}
+	}
+	ctx.nodes = slices.DeleteFunc(ctx.nodes, func(node ast.Node) bool {
+		return remove[node]
+	})
+	return nil
+}
+
+// canonicalStruct returns serialized struct with fields sorted by name.
+func canonicalStruct(str *ast.Struct) string {
+	str = str.Clone().(*ast.Struct)
+	str.Comments = nil
+	slices.SortFunc(str.Fields, func(a, b *ast.Field) int {
+		return strings.Compare(a.Name.Name, b.Name.Name)
+	})
+	return ast.SerializeNode(str)
+}
+
+// SerializeProvenance returns source files for all nodes in the final descriptions (except for new lines).
+// Unnamed nodes (e.g. includes) are identified by their quoted text. Lines look as follows:
+//
+//	STRUCT	foo$auto_record	file:drivers/foo/foo.c	file:drivers/foo/bar.c
+//	INCLUDE	"include <include/linux/foo.h>"	file:drivers/foo/foo.c
+func SerializeProvenance(desc *ast.Description, provenance map[ast.Node][]string) []byte {
+	w := new(bytes.Buffer)
+	for _, node := range desc.Nodes {
+		_, typ, _ := node.Info()
+		files := provenance[node]
+		if _, ok := node.(*ast.NewLine); ok || len(files) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%v\t%v", strings.ToUpper(typ), provenanceName(node))
+		for _, file := range files {
+			fmt.Fprintf(w, "\tfile:%v", file)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	return w.Bytes()
+}
+
+// provenanceName returns the name of the node, or the quoted text of unnamed nodes (see SerializeProvenance).
+func provenanceName(node ast.Node) string {
+	if _, _, name := node.Info(); name != "" {
+		return name
+	}
+	return strconv.Quote(strings.TrimSpace(string(ast.SerializeNode(node))))
+}
+
+// provenanceKey returns the key of the node in Config.PrevProvenance.
+func provenanceKey(node ast.Node) string {
+	_, typ, _ := node.Info()
+	return fmt.Sprintf("%v/%v", typ, provenanceName(node))
+}
+
+// ParseProvenance parses the source files of nodes written by SerializeProvenance (see Config.PrevProvenance).
+func ParseProvenance(data []byte) (map[string][]string, error) {
+	provenance := make(map[string][]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("line %v: want type, name and files, got %q", i+1, line)
+		}
+		var files []string
+		for _, field := range fields[2:] {
+			file, ok := strings.CutPrefix(field, "file:")
+			if !ok {
+				return nil, fmt.Errorf("line %v: bad file %q", i+1, field)
+			}
+			files = append(files, file)
+		}
+		key := fmt.Sprintf("%v/%v", strings.ToLower(fields[0]), fields[1])
+		provenance[key] = append(provenance[key], files...)
+	}
+	for key, files := range provenance {
+		slices.Sort(files)
+		provenance[key] = slices.Compact(files)
+	}
+	return provenance, nil
+}
+
+// DiffDescriptions returns a readable diff between two versions of descriptions grouped by top-level nodes.
+// Nodes are matched by type/name, output looks as follows:
+//
+//	added SYSCALL read$auto:
+//	+read$auto(fd fd)
+//	modified STRUCT foo$auto:
+//	-foo$auto {
+//	+foo$auto {
+//	...
+func DiffDescriptions(prev, desc *ast.Description) []byte {
+	prevNodes, nodes := diffNodes(prev), diffNodes(desc)
+	var keys []string
+	for key := range prevNodes {
+		keys = append(keys, key)
+	}
+	for key := range nodes {
+		if _, ok := prevNodes[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	w := new(bytes.Buffer)
+	for _, key := range keys {
+		before, after := prevNodes[key], nodes[key]
+		switch {
+		case before == after:
+			continue
+		case before == "":
+			fmt.Fprintf(w, "added %v:\n", key)
+		case after == "":
+			fmt.Fprintf(w, "removed %v:\n", key)
+		default:
+			fmt.Fprintf(w, "modified %v:\n", key)
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(before, "\n"), "\n") {
+			if line != "" {
+				fmt.Fprintf(w, "-%v\n", line)
+			}
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(after, "\n"), "\n") {
+			if line != "" {
+				fmt.Fprintf(w, "+%v\n", line)
+			}
+		}
+	}
+	return w.Bytes()
+}
+
+// diffNodes returns serialized top-level nodes keyed by type and name.
+func diffNodes(desc *ast.Description) map[string]string {
+	nodes := make(map[string]string)
+	if desc == nil {
+		return nodes
+	}
+	for _, node := range desc.Nodes {
+		_, typ, name := node.Info()
+		switch n := node.(type) {
+		case *ast.NewLine, *ast.Comment:
+			continue
+		case *ast.Include:
+			name = n.File.Value
+		}
+		key := fmt.Sprintf("%v %v", strings.ToUpper(typ), name)
+		nodes[key] += ast.SerializeNode(node)
+	}
+	return nodes
+}
+
+func sortNodes(nodes []ast.Node) []ast.Node {
+	slices.SortFunc(nodes, func(a, b ast.Node) int {
+		return strings.Compare(ast.SerializeNode(a), ast.SerializeNode(b))
+	})
+	nodes = slices.CompactFunc(nodes, func(a, b ast.Node) bool {
+		return ast.SerializeNode(a) == ast.SerializeNode(b)
+	})
+	// Calls and attribute policies of each netlink family go together after the rest of nodes of the same type.
+	families := netlinkNodeFamilies(nodes)
+	slices.SortStableFunc(nodes, func(a, b ast.Node) int {
+		if res := getTypeOrder(a) - getTypeOrder(b); res != 0 {
+			return res
+		}
+		return strings.Compare(families[a], families[b])
+	})
+	return nodes
+}
+
+// CompileCheck compiles all descriptions in the dir (e.g. sys/linux after the auto descriptions
+// are written) with the consts from the .const files in the dir for each of the arches
+// (all arches of the target OS if none are specified), and returns the compilation errors.
+// The consts of new descriptions are generated by syz-extract, so it needs to run before the check.
+// Descriptions that are not compiled due to missing consts are logged to the logger (slog.Default()
+// if nil) as a warning, they don't fail the check.
+func CompileCheck(dir string, arches []string, logger *slog.Logger) error {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	var errs []string
+	eh := func(pos ast.Pos, msg string) {
+		errs = append(errs, fmt.Sprintf("%v: %v", pos, msg))
+	}
+	desc := ast.ParseGlob(filepath.Join(dir, "*.txt"), eh)
+	if desc == nil {
+		return fmt.Errorf("failed to parse descriptions:\n%v", strings.Join(errs, "\n"))
+	}
+	consts := compiler.DeserializeConstFile(filepath.Join(dir, "*.const"), eh)
+	if consts == nil {
+		return fmt.Errorf("failed to parse consts:\n%v", strings.Join(errs, "\n"))
+	}
+	if len(arches) == 0 {
+		for arch := range targets.List[target.OS] {
+			arches = append(arches, arch)
+		}
+		slices.Sort(arches)
+	}
+	// The same errors are usually reported for all arches.
+	errArches := make(map[string][]string)
+	warnArches := make(map[string][]string)
+	for _, arch := range arches {
+		archTarget := targets.Get(target.OS, arch)
+		if archTarget == nil {
+			return fmt.Errorf("unknown arch %v", arch)
+		}
+		errs = nil
+		// The compiler reports warnings (descriptions unsupported due to missing consts)
+		// to the error handler only if there are no errors.
+		msgs := errArches
+		if compiler.Compile(desc.Clone(), consts.Arch(arch), archTarget, eh) != nil {
+			msgs = warnArches
+		}
+		for _, err := range slices.Compact(errs) {
+			msgs[err] = append(msgs[err], arch)
+		}
+	}
+	if len(warnArches) != 0 {
+		var lines []string
+		for msg, arches := range warnArches {
+			lines = append(lines, fmt.Sprintf("%v (%v)", msg, strings.Join(arches, ", ")))
+		}
+		slices.Sort(lines)
+		for _, line := range lines {
+			logger.Debug(line, "phase", "finish")
+		}
+		logger.Warn(fmt.Sprintf("%v descriptions are not compiled due to missing consts"+
+			" (run syz-extract before the check to generate consts of new descriptions)", len(lines)),
+			"phase", "finish")
+	}
+	if len(errArches) == 0 {
+		return nil
+	}
+	var lines []string
+	for err, arches := range errArches {
+		lines = append(lines, fmt.Sprintf("%v (%v)", err, strings.Join(arches, ", ")))
+	}
+	slices.Sort(lines)
+	return fmt.Errorf("descriptions don't compile:\n%v", strings.Join(lines, "\n"))
+}
+
+// mergeNodes merges freshly extracted nodes into the previously generated descriptions.
+// Previous nodes are replaced by new nodes with the same type/name, the rest of them are preserved.
+func mergeNodes(prev, nodes []ast.Node, includes []string) []ast.Node {
+	replaced := make(map[string]bool)
+	for _, node := range nodes {
+		if _, _, name := node.Info(); name != "" {
+			replaced[nodeKey(node)] = true
+		}
+	}
+	for _, node := range generatedNodes(prev, includes) {
+		if !replaced[nodeKey(node)] {
+			nodes = append(nodes, node)
+		}
+	}
+	return sortNodes(nodes)
+}
+
+// generatedNodes returns the previously generated nodes without the nodes that are added to
+// the descriptions anew (newlines, the header, and annotations).
+func generatedNodes(prev []ast.Node, includes []string) []ast.Node {
+	header := make(map[string]bool)
+	for _, node := range headerNodes("", includes) {
+		header[ast.SerializeNode(node)] = true
+	}
+	var nodes []ast.Node
+	for _, node := range prev {
+		if _, ok := node.(*ast.NewLine); ok || header[ast.SerializeNode(node)] ||
+			versionComment(node) != "" || annotationComment(node) {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+// DefaultHeaderIncludes are included at the top of the descriptions (see Config.HeaderIncludes).
+var DefaultHeaderIncludes = []string{
+	"include/vdso/bits.h",
+	"include/linux/types.h",
+}
+
+func (ctx *context) headerIncludes() []string {
+	if ctx.cfg.HeaderIncludes == nil {
+		return DefaultHeaderIncludes
+	}
+	return ctx.cfg.HeaderIncludes
+}
+
+func headerNodes(version string, includes []string) []ast.Node {
+	// These additional includes must be at the top (added after sorting), because other kernel headers
+	// are broken and won't compile without these additional ones included first.
+	header := "# Code generated by syz-declextract. DO NOT EDIT.\n"
+	if version != "" {
+		header += "# " + versionPrefix + version + "\n"
+	}
+	if len(includes) != 0 {
+		header += "\n"
+	}
+	for _, inc := range includes {
+		header += fmt.Sprintf("include <%v>\n", inc)
+	}
+	desc := ast.Parse([]byte(header), "", func(pos ast.Pos, msg string) {})
+	if desc == nil {
+		return nil
+	}
+	return desc.Nodes
+}
+
+const versionPrefix = "Generated with: "
+
+// Version returns version of the binary and of syzkaller that is recorded in the generated descriptions.
+func Version(binary string) (string, error) {
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("binary %.12v, syzkaller %v", hash.String(data), prog.GitRevision), nil
+}
+
+// DescriptionsVersion returns the version recorded in the generated descriptions (see Version),
+// or an empty string if there is none.
+func DescriptionsVersion(desc *ast.Description) string {
+	for _, node := range desc.Nodes {
+		if version := versionComment(node); version != "" {
+			return version
+		}
+	}
+	return ""
+}
+
+func versionComment(node ast.Node) string {
+	comment, ok := node.(*ast.Comment)
+	if !ok {
+		return ""
+	}
+	version, ok := strings.CutPrefix(strings.TrimSpace(comment.Text), versionPrefix)
+	if !ok {
+		return ""
+	}
+	return version
+}
+
+const annotationPrefix = "subsystem: "
+
+// annotateCalls inserts a comment with subsystems and source files before each call
+// (the files are not known for calls added/changed by Config.NodeTransform and for previous descriptions).
+// The comments are added after the nodes are sorted and deduplicated, and are dropped from the previous
+// descriptions when they are merged, since they are regenerated.
+func (ctx *context) annotateCalls(desc *ast.Description) {
+	cache := make(map[string][]string)
+	var nodes []ast.Node
+	for _, node := range desc.Nodes {
+		files := ctx.provenance[node]
+		if _, ok := node.(*ast.Call); ok && len(files) != 0 {
+			subsystems := strings.Join(ctx.fileSubsystems(files, cache), " ")
+			if subsystems == "" {
+				subsystems = "-"
+			}
+			nodes = append(nodes, &ast.Comment{
+				Text: fmt.Sprintf(" %v%v, file: %v", annotationPrefix, subsystems, strings.Join(files, " ")),
+			})
+		}
+		nodes = append(nodes, node)
+	}
+	desc.Nodes = nodes
+}
+
+func annotationComment(node ast.Node) bool {
+	comment, ok := node.(*ast.Comment)
+	return ok && strings.HasPrefix(strings.TrimSpace(comment.Text), annotationPrefix)
+}
+
+func nodeKey(n ast.Node) string {
+	_, typ, name := n.Info()
+	return fmt.Sprintf("%v/%v", typ, name)
+}
+
+// allDescriptions returns the complete descriptions for the target OS
+// with desc in place of the auto-generated descriptions file (if desc is nil, the existing file is used).
+func (ctx *context) allDescriptions(desc *ast.Description) (*ast.Description, error) {
+	if ctx.existing == nil {
+		ctx.existing = ast.ParseGlob(filepath.Join(filepath.Dir(ctx.cfg.AutoFile), "*.txt"), ctx.errorHandler("finish"))
+		if ctx.existing == nil {
+			return nil, fmt.Errorf("failed to parse descriptions")
+		}
+		ctx.manual = ctx.existing.Filter(func(n ast.Node) bool {
+			pos, _, _ := n.Info()
+			return pos.File != ctx.cfg.AutoFile
+		})
+	}
+	if desc == nil {
+		return ctx.existing, nil
+	}
+	auto := ast.Parse(ast.Format(desc), ctx.cfg.AutoFile, ctx.errorHandler("finish"))
+	if auto == nil {
+		return nil, fmt.Errorf("failed to parse generated descriptions")
+	}
+	all := ctx.manual.Clone()
+	all.Nodes = append(all.Nodes, auto.Nodes...)
+	return all, nil
+}
+
+func (ctx *context) removeUnused(desc *ast.Description) error {
+	// Auto descriptions use some types defined by manual descriptions,
+	// so compiler.CollectUnused requires complete descriptions.
+	all, err := ctx.allDescriptions(desc)
+	if err != nil {
+		return err
+	}
+	// References to undefined types in the auto descriptions mean that the extraction is incomplete,
+	// so they are reported with the nodes they come from (the typecheck error reports only the types).
+	var undefined []string
+	eh := ctx.errorHandler("finish")
+	unusedNodes, err := compiler.CollectUnused(all, target, func(pos ast.Pos, msg string) {
+		if typ, ok := strings.CutPrefix(msg, "unknown type "); ok && pos.File == ctx.cfg.AutoFile {
+			undefined = append(undefined, fmt.Sprintf("%v: %v references undefined type %v",
+				pos, nodeAt(all.Nodes, pos), typ))
+		}
+		eh(pos, msg)
+	})
+	if err != nil {
+		if len(undefined) != 0 {
+			return fmt.Errorf("generated descriptions reference undefined types:\n%v",
+				strings.Join(undefined, "\n"))
+		}
+		return fmt.Errorf("failed to typecheck descriptions: %w", err)
+	}
+	unused := make(map[string]bool)
+	for _, n := range unusedNodes {
+		if pos, _, _ := n.Info(); pos.File == ctx.cfg.AutoFile {
+			unused[nodeKey(n)] = true
+		}
+	}
+	desc.Nodes = slices.DeleteFunc(desc.Nodes, func(n ast.Node) bool {
+		return unused[nodeKey(n)]
+	})
+	return nil
+}
+
+// nodeAt returns the type and the name of the node that contains pos, i.e. the last node of the file
+// that starts before pos (nodes of each file are in the order of their positions).
+func nodeAt(nodes []ast.Node, pos ast.Pos) string {
+	var res ast.Node
+	for _, node := range nodes {
+		start, _, _ := node.Info()
+		if start.File != pos.File {
+			continue
+		}
+		if start.Line > pos.Line || start.Line == pos.Line && start.Col > pos.Col {
+			break
+		}
+		res = node
+	}
+	if res == nil {
+		return "unknown node"
+	}
+	_, typ, name := res.Info()
+	return fmt.Sprintf("%v %v", typ, name)
+}
+
+func getTypeOrder(a ast.Node) int {
+	switch a.(type) {
+	case *ast.Comment:
+		return 0
+	case *ast.Include:
+		return 1
+	case *ast.Define:
+		return 2
+	case *ast.IntFlags:
+		return 3
+	case *ast.Resource:
+		return 4
+	case *ast.TypeDef:
+		return 5
+	case *ast.Call:
+		return 6
+	case *ast.Struct:
+		return 7
+	case *ast.NewLine:
+		return 8
+	default:
+		// Unknown node types are reported in appendNodes.
+		return unknownTypeOrder
+	}
+}
+
+// NodeTypes are names of node types in the order of getTypeOrder (see Config.ExcludeNodeTypes).
+var NodeTypes = []string{"comment", "include", "define", "intflags", "resource", "typedef", "call", "struct"}
+
+// excludeNodeTypes removes nodes of the types (names from NodeTypes).
+func excludeNodeTypes(nodes []ast.Node, types []string) []ast.Node {
+	return slices.DeleteFunc(nodes, func(node ast.Node) bool {
+		order := getTypeOrder(node)
+		return order < len(NodeTypes) && slices.Contains(types, NodeTypes[order])
+	})
+}
+
+// unknownTypeOrder is the order of node types not handled by getTypeOrder (they go last).
+const unknownTypeOrder = 9
+
+// DescriptionStats contains numbers of distinct (by name) nodes of descriptions.
+// Sudden growth between runs is a sign of the same types emitted under varying names.
+type DescriptionStats struct {
+	Calls     int
+	Structs   int // including unions
+	Resources int
+	TypeDefs  int
+	// Structs that have the same name as other structs up to a numeric suffix (e.g. foo, foo_1 and foo2).
+	NearDuplicateStructs int
+}
+
+// GetDescriptionStats returns stats of the descriptions.
+func GetDescriptionStats(desc *ast.Description) DescriptionStats {
+	names := make(map[string]map[string]bool)
+	add := func(typ, name string) {
+		if names[typ] == nil {
+			names[typ] = make(map[string]bool)
+		}
+		names[typ][name] = true
+	}
+	for _, node := range desc.Nodes {
+		switch n := node.(type) {
+		case *ast.Call:
+			add("call", n.Name.Name)
+		case *ast.Struct:
+			add("struct", n.Name.Name)
+		case *ast.Resource:
+			add("resource", n.Name.Name)
+		case *ast.TypeDef:
+			add("typedef", n.Name.Name)
+		}
+	}
+	prefixes := make(map[string]int)
+	for name := range names["struct"] {
+		prefixes[strings.TrimRight(strings.TrimRight(name, "0123456789"), "_")]++
+	}
+	stats := DescriptionStats{
+		Calls:     len(names["call"]),
+		Structs:   len(names["struct"]),
+		Resources: len(names["resource"]),
+		TypeDefs:  len(names["typedef"]),
+	}
+	for _, n := range prefixes {
+		if n > 1 {
+			stats.NearDuplicateStructs += n
+		}
+	}
+	return stats
+}
+
+func (stats DescriptionStats) String() string {
+	return fmt.Sprintf("%v calls, %v structs (%v near-duplicates), %v resources, %v typedefs",
+		stats.Calls, stats.Structs, stats.NearDuplicateStructs, stats.Resources, stats.TypeDefs)
+}
+
+// rawFile is the start of nodes extracted from the file in context.nodes (see Config.RawFile).
+type rawFile struct {
+	file  string
+	start int
+}
+
+// writeRaw writes the nodes and the interfaces as they were extracted (see Config.RawFile).
+// Nodes of each file are preceded by a comment with the file name.
+func (ctx *context) writeRaw() error {
+	var nodes []ast.Node
+	for i, raw := range ctx.rawFiles {
+		end := len(ctx.nodes)
+		if i+1 < len(ctx.rawFiles) {
+			end = ctx.rawFiles[i+1].start
+		}
+		nodes = append(nodes, &ast.NewLine{}, &ast.Comment{Text: " file: " + raw.file})
+		nodes = append(nodes, ctx.nodes[raw.start:end]...)
+	}
+	if err := osutil.WriteFile(ctx.cfg.RawFile, ast.Format(&ast.Description{Nodes: nodes})); err != nil {
+		return err
+	}
+	var interfaces []Interface
+	for _, iface := range ctx.interfaces {
+		interfaces = append(interfaces, iface)
+	}
+	slices.SortFunc(interfaces, func(a, b Interface) int {
+		return strings.Compare(a.ID(), b.ID())
+	})
+	return osutil.WriteFile(ctx.cfg.RawFile+".info", SerializeInterfaces(interfaces))
+}
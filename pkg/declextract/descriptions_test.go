@@ -0,0 +1,468 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/google/syzkaller/pkg/ast"
+	"github.com/google/syzkaller/pkg/osutil"
+	"github.com/google/syzkaller/pkg/subsystem"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffDescriptions(t *testing.T) {
+	prev := &ast.Description{Nodes: parseNodes(t, `
+# Code generated by syz-declextract. DO NOT EDIT.
+
+include <include/linux/types.h>
+include <include/linux/fs.h>
+
+read$auto(fd fd)
+write$auto(fd fd)
+
+foo$auto {
+	a	int32
+}
+`)}
+	desc := &ast.Description{Nodes: parseNodes(t, `
+# Code generated by syz-declextract. DO NOT EDIT.
+
+include <include/linux/types.h>
+include <include/linux/net.h>
+
+read$auto(fd fd)
+open$auto(file ptr[in, filename])
+
+foo$auto {
+	a	int64
+}
+`)}
+	assert.Equal(t, `removed INCLUDE include/linux/fs.h:
+-include <include/linux/fs.h>
+added INCLUDE include/linux/net.h:
++include <include/linux/net.h>
+modified STRUCT foo$auto:
+-foo$auto {
+-	a	int32
+-}
++foo$auto {
++	a	int64
++}
+added SYSCALL open$auto:
++open$auto(file ptr[in, filename])
+removed SYSCALL write$auto:
+-write$auto(fd fd)
+`, string(DiffDescriptions(prev, desc)))
+	assert.Empty(t, DiffDescriptions(desc, desc))
+}
+
+func TestUnknownNodeType(t *testing.T) {
+	ctx := &context{
+		interfaces: make(map[string]Interface),
+	}
+	mustAppendNodes(t, ctx, parseNodes(t, `
+meta noextract
+define FOO 1
+`), "fs/read_write.c")
+	assert.Equal(t, 1, ctx.warnings)
+	nodes := sortNodes(ctx.nodes)
+	if _, ok := nodes[len(nodes)-1].(*ast.Meta); !ok {
+		t.Fatalf("unknown node type is not last: %T", nodes[len(nodes)-1])
+	}
+}
+
+func TestMergeStructs(t *testing.T) {
+	newContext := func(data string) *context {
+		return &context{
+			cfg:   &Config{MergeStructs: true},
+			nodes: parseNodes(t, data),
+		}
+	}
+	ctx := newContext(`
+foo$auto {
+	a	int32
+	b	int64
+}
+
+foo$auto {
+	b	int64
+	a	int32
+}
+
+bar$auto {
+	a	int32
+}
+`)
+	if err := ctx.finishDescriptions(); err != nil {
+		t.Fatal(err)
+	}
+	var structs []string
+	for _, node := range ctx.nodes {
+		if str, ok := node.(*ast.Struct); ok {
+			structs = append(structs, ast.SerializeNode(str))
+		}
+	}
+	assert.Equal(t, []string{
+		"bar$auto {\n\ta\tint32\n}\n",
+		"foo$auto {\n\ta\tint32\n\tb\tint64\n}\n",
+	}, structs)
+
+	ctx = newContext(`
+foo$auto {
+	a	int32
+}
+
+foo$auto {
+	a	int64
+}
+`)
+	assert.Error(t, ctx.finishDescriptions())
+}
+
+func TestHeaderIncludes(t *testing.T) {
+	format := func(nodes []ast.Node) string {
+		return string(ast.Format(&ast.Description{Nodes: nodes}))
+	}
+	assert.Equal(t, `# Code generated by syz-declextract. DO NOT EDIT.
+# Generated with: v1
+
+include <include/vdso/bits.h>
+include <include/linux/types.h>
+`, format(headerNodes("v1", DefaultHeaderIncludes)))
+	assert.Equal(t, "# Code generated by syz-declextract. DO NOT EDIT.\n", format(headerNodes("", nil)))
+	assert.Nil(t, headerNodes("", []string{"foo bar>"}))
+	_, err := Extract(&Config{HeaderIncludes: []string{"foo bar>"}})
+	assert.ErrorContains(t, err, "bad header include")
+}
+
+func TestGroupIncludes(t *testing.T) {
+	header := headerNodes("", DefaultHeaderIncludes)
+	nodes := parseNodes(t, `
+# INTERFACE comment
+include <include/uapi/linux/stat.h>
+read$auto(fd fd)
+include <include/linux/types.h>
+include <include/linux/fs.h>
+include <include/uapi/linux/stat.h>
+`)
+	desc := &ast.Description{Nodes: groupIncludes(header, nodes)}
+	assert.Equal(t, `# Code generated by syz-declextract. DO NOT EDIT.
+
+include <include/vdso/bits.h>
+include <include/linux/types.h>
+include <include/linux/fs.h>
+include <include/uapi/linux/stat.h>
+
+# INTERFACE comment
+read$auto(fd fd)
+`, string(ast.Format(desc)))
+}
+
+func TestRenameDuplicateCalls(t *testing.T) {
+	rename := func(data string) []string {
+		nodes := sortNodes(parseNodes(t, data))
+		renameDuplicateCalls(nodes)
+		return callNames(nodes)
+	}
+	two := rename(`
+read$auto(a fd)
+read$auto(b fd)
+write$auto(fd fd)
+`)
+	assert.Len(t, two, 3)
+	assert.Regexp(t, `^read\$auto_[0-9a-f]{8}$`, two[0])
+	assert.Regexp(t, `^read\$auto_[0-9a-f]{8}$`, two[1])
+	assert.NotEqual(t, two[0], two[1])
+	assert.Equal(t, "write$auto", two[2])
+	// Adding a variant does not rename the existing ones.
+	three := rename(`
+read$auto(a fd)
+read$auto(c fd)
+read$auto(b fd)
+write$auto(fd fd)
+`)
+	assert.Subset(t, three, two)
+	assert.Len(t, three, 4)
+	// A call that happens to have the name of a renamed variant does not collide with it.
+	collision := rename(`
+read$auto(a fd)
+read$auto(b fd)
+` + two[0] + `(x fd)
+`)
+	assert.Len(t, collision, 3)
+	assert.Contains(t, collision, two[0])
+	assert.Contains(t, collision, two[1])
+	extended := slices.DeleteFunc(collision, func(name string) bool { return name == two[0] || name == two[1] })
+	assert.Len(t, extended, 1)
+	assert.Regexp(t, `^read\$auto_[0-9a-f]{12}$`, extended[0])
+}
+
+func TestExcludeNodeTypes(t *testing.T) {
+	nodes := excludeNodeTypes(parseNodes(t, `
+# comment
+include <include/linux/fs.h>
+foo_flags = FOO_A, FOO_B
+resource fd_foo[fd]
+read$auto(fd fd_foo)
+foo {
+	a	flags[foo_flags, int32]
+}
+`), []string{"intflags", "comment"})
+	var types []string
+	for _, node := range nodes {
+		if _, ok := node.(*ast.NewLine); !ok {
+			types = append(types, NodeTypes[getTypeOrder(node)])
+		}
+	}
+	assert.Equal(t, []string{"include", "resource", "call", "struct"}, types)
+}
+
+func TestUndefinedTypes(t *testing.T) {
+	dir := t.TempDir()
+	if err := osutil.WriteFile(filepath.Join(dir, "sys.txt"), []byte("resource fd[int32]\nclose(fd fd)\n")); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &context{
+		cfg: &Config{
+			AutoFile: filepath.Join(dir, "auto.txt"),
+			Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		},
+	}
+	desc := &ast.Description{Nodes: parseNodes(t, `
+read$auto(fd fd, buf ptr[out, foo])
+foo {
+	a	int32
+	b	bar
+}
+`)}
+	err := ctx.removeUnused(desc)
+	assert.ErrorContains(t, err, "generated descriptions reference undefined types:\n"+
+		filepath.Join(dir, "auto.txt")+":6:4: struct foo references undefined type bar")
+}
+
+func TestAnnotateCalls(t *testing.T) {
+	ctx := &context{
+		extractor: subsystem.MakeExtractor([]*subsystem.Subsystem{
+			{Name: "fs", PathRules: []subsystem.PathRule{{IncludeRegexp: "^fs/"}}},
+		}),
+		provenance: make(map[ast.Node][]string),
+	}
+	desc := &ast.Description{Nodes: parseNodes(t, `
+read$auto(fd fd)
+write$auto(fd fd)
+foo$auto(fd fd)
+foo {
+	a	int32
+}
+`)}
+	files := map[string][]string{
+		"read$auto":  {"fs/read_write.c"},
+		"write$auto": {"fs/read_write.c", "mm/write.c"},
+		"foo$auto":   {"drivers/foo.c"},
+		"foo":        {"drivers/foo.c"},
+	}
+	for _, node := range desc.Nodes {
+		if _, _, name := node.Info(); name != "" {
+			ctx.provenance[node] = files[name]
+		}
+	}
+	ctx.annotateCalls(desc)
+	assert.Equal(t, `
+# subsystem: fs, file: fs/read_write.c
+read$auto(fd fd)
+# subsystem: fs, file: fs/read_write.c mm/write.c
+write$auto(fd fd)
+# subsystem: -, file: drivers/foo.c
+foo$auto(fd fd)
+
+foo {
+	a	int32
+}
+`, string(ast.Format(desc)))
+
+	// Annotations of the previous descriptions are regenerated.
+	merged := mergeNodes(desc.Nodes, parseNodes(t, "read$auto(fd fd)\n"), nil)
+	assert.False(t, slices.ContainsFunc(merged, annotationComment))
+	assert.Equal(t, []string{"foo$auto", "read$auto", "write$auto"}, callNames(merged))
+}
+
+func TestMergeByProvenance(t *testing.T) {
+	run := func(files map[string]string, prev *ast.Description, prevProvenance map[string][]string,
+		cmds []CompileCommand) (*ast.Description, map[string][]string) {
+		ctx := &context{
+			cfg: &Config{
+				KernelSrc:        "/src",
+				KernelObj:        "/src",
+				CompileCommands:  cmds,
+				PrevDescriptions: prev,
+				PrevProvenance:   prevProvenance,
+			},
+			nodeFiles: make(map[string][]string),
+		}
+		for file, data := range files {
+			ctx.addNodes(file, parseNodes(t, data)...)
+		}
+		if err := ctx.finishDescriptions(); err != nil {
+			t.Fatal(err)
+		}
+		desc := &ast.Description{Nodes: ctx.nodes}
+		ctx.annotateCalls(desc)
+		provenance, err := ParseProvenance(SerializeProvenance(desc, ctx.provenance))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return desc, provenance
+	}
+	const b = "include <b.h>\ninclude <common.h>\nread$auto(b fd)\nwrite$auto(fd fd)\nfoo {\n\ta\tint32\n}\n"
+	prev, prevProvenance := run(map[string]string{
+		"a.c": "include <a.h>\ninclude <common.h>\n# comment a\nread$auto(a fd)\n" +
+			"foo {\n\ta\tint32\n}\nbaz {\n\ta\tint32\n}\n",
+		"b.c": b,
+		"c.c": "include <c.h>\n# comment c\nclose$auto(fd fd)\n",
+	}, nil, nil, nil)
+	assert.Equal(t, []string{"a.c", "b.c"}, prevProvenance["struct/foo"])
+	assert.Equal(t, []string{"a.c", "b.c"}, prevProvenance[`include/"include <common.h>"`])
+	// Only a.c and c.c have changed: a.c defines foo differently, baz and one of the read variants are gone,
+	// and c.c does not produce anything anymore.
+	changed := map[string]string{
+		"a.c": "include <a2.h>\ninclude <common.h>\nread$auto(c fd)\nfoo {\n\tb\tint64\n}\nqux {\n\ta\tint32\n}\n",
+	}
+	desc, provenance := run(changed, prev, prevProvenance, []CompileCommand{{File: "a.c"}, {File: "c.c"}})
+	changed["b.c"] = b
+	full, fullProvenance := run(changed, nil, nil, nil)
+	assert.Equal(t, string(ast.Format(full)), string(ast.Format(desc)))
+	assert.Equal(t, fullProvenance, provenance)
+	assert.Equal(t, []string{"a.c", "b.c"}, provenance["struct/foo"])
+	assert.NotContains(t, provenance, "struct/baz")
+	assert.NotContains(t, provenance, `include/"include <c.h>"`)
+}
+
+func TestCanonicalizeDescriptions(t *testing.T) {
+	desc := &ast.Description{Nodes: parseNodes(t, `
+foo_flags = FOO_C, FOO_A, 0x2, FOO_A, 1, 2
+bar_flags = "b", "a", "b"
+
+foo {
+	b	int32
+	a	flags[foo_flags, int32]
+}
+`)}
+	canonicalizeDescriptions(desc)
+	assert.Equal(t, `
+foo_flags = 1, 0x2, FOO_A, FOO_C
+bar_flags = "a", "b"
+
+foo {
+	b	int32
+	a	flags[foo_flags, int32]
+}
+`, string(ast.Format(desc)))
+}
+
+func TestCompileCheck(t *testing.T) {
+	dir := t.TempDir()
+	for file, data := range map[string]string{
+		"sys.txt":       "resource fd[int32]\nopen(file ptr[in, filename]) fd\nclose(fd fd)\n",
+		"sys.txt.const": "arches = 386, amd64\n__NR_open = 2\n__NR_close = 3\n",
+	} {
+		if err := osutil.WriteFile(filepath.Join(dir, file), []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.NoError(t, CompileCheck(dir, []string{"amd64", "386"}, nil))
+	// Consts of the new descriptions are not generated yet.
+	if err := osutil.WriteFile(filepath.Join(dir, "auto.txt"), []byte("read$auto(fd fd)\n")); err != nil {
+		t.Fatal(err)
+	}
+	logs := new(bytes.Buffer)
+	assert.NoError(t, CompileCheck(dir, []string{"amd64", "386"}, slog.New(slog.NewTextHandler(logs, nil))))
+	assert.Contains(t, logs.String(), "1 descriptions are not compiled due to missing consts")
+	// Conflicts with the manual descriptions.
+	if err := osutil.WriteFile(filepath.Join(dir, "auto.txt"), []byte("close(fd int32)\n")); err != nil {
+		t.Fatal(err)
+	}
+	err := CompileCheck(dir, []string{"amd64", "386"}, nil)
+	assert.ErrorContains(t, err, "syscall close redeclared, previously declared at "+filepath.Join(dir, "auto.txt"))
+	assert.ErrorContains(t, err, "(amd64, 386)")
+	assert.Error(t, CompileCheck(dir, []string{"vax"}, nil))
+}
+
+func TestDescriptionStats(t *testing.T) {
+	desc := &ast.Description{Nodes: parseNodes(t, `
+resource fd_foo[fd]
+foo$auto(fd fd_foo, arg ptr[in, foo_arg])
+foo$auto(fd fd_foo, arg ptr[in, foo_arg_1])
+bar$auto(arg ptr[in, bar])
+type auto_todo intptr
+foo_arg {
+	a	int32
+}
+foo_arg_1 {
+	a	int32
+}
+foo_arg2 [
+	a	int32
+]
+bar {
+	a	int32
+}
+bar_baz {
+	a	int32
+}
+`)}
+	stats := GetDescriptionStats(desc)
+	assert.Equal(t, DescriptionStats{
+		Calls:                2,
+		Structs:              5,
+		Resources:            1,
+		TypeDefs:             1,
+		NearDuplicateStructs: 3,
+	}, stats)
+	assert.Equal(t, "2 calls, 5 structs (3 near-duplicates), 1 resources, 1 typedefs", stats.String())
+}
+
+func TestWriteRaw(t *testing.T) {
+	rawFile := filepath.Join(t.TempDir(), "raw.txt")
+	ctx := &context{
+		cfg:            &Config{RawFile: rawFile},
+		syscallNameMap: map[string][]string{"read": {"read"}, "setuid16": {"setuid"}},
+		interfaces:     make(map[string]Interface),
+	}
+	mustAppendNodes(t, ctx, parseNodes(t, `
+#INTERFACE: SYSCALL read read read user
+read(fd fd)
+`), "fs/read_write.c")
+	mustAppendNodes(t, ctx, parseNodes(t, `
+setuid16(uid int32)
+`), "kernel/uid16.c")
+	if err := ctx.writeRaw(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(rawFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `
+# file: fs/read_write.c
+
+read$auto(fd fd)
+
+# file: kernel/uid16.c
+
+setuid$auto(uid int32)
+`, string(data))
+	data, err = os.ReadFile(rawFile + ".info")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "SYSCALL\tread\tfunc:read\taccess:user\tmanual_desc:false\tauto_desc:false"+
+		"\tfile:fs/read_write.c\n", string(data))
+}
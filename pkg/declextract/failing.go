@@ -0,0 +1,96 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Files that failed in the previous runs are recorded in the cache dir,
+// so that they can be reported (and skipped) before the next run.
+const failingFilesName = "failing"
+
+// FailingFile is a file that failed in the previous runs. The same file may fail in some builds only,
+// so files are recorded with the compilation database of the build (see CompileCommand.Database).
+type FailingFile struct {
+	Database string
+	File     string
+}
+
+func (f FailingFile) String() string {
+	if f.Database == "" {
+		return f.File
+	}
+	return fmt.Sprintf("%v (%v)", f.File, f.Database)
+}
+
+func compareFailingFiles(a, b FailingFile) int {
+	return cmp.Or(cmp.Compare(a.File, b.File), cmp.Compare(a.Database, b.Database))
+}
+
+// LoadFailingFiles returns the sorted list of files that failed in the previous runs
+// with the cache dir and did not succeed since then.
+func LoadFailingFiles(cacheDir string) ([]FailingFile, error) {
+	data, err := os.ReadFile(filepath.Join(cacheDir, failingFilesName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var files []FailingFile
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		// Each line is "database\tfile", lines without the database are files of builds without one.
+		var f FailingFile
+		if database, file, ok := strings.Cut(line, "\t"); ok {
+			f = FailingFile{Database: database, File: file}
+		} else {
+			f = FailingFile{File: line}
+		}
+		files = append(files, f)
+	}
+	slices.SortFunc(files, compareFailingFiles)
+	return slices.Compact(files), nil
+}
+
+// updateFailingFiles adds files that failed in this run to the recorded list,
+// and removes files that succeeded.
+func (ctx *context) updateFailingFiles(results map[FailingFile]bool) {
+	if ctx.cfg.CacheDir == "" || len(results) == 0 {
+		return
+	}
+	files, err := LoadFailingFiles(ctx.cfg.CacheDir)
+	if err != nil {
+		ctx.logger().Warn("failed to load failing files: "+err.Error(), "phase", "extract")
+	}
+	files = slices.DeleteFunc(files, func(file FailingFile) bool {
+		return results[file]
+	})
+	for file, ok := range results {
+		if !ok {
+			files = append(files, file)
+		}
+	}
+	slices.SortFunc(files, compareFailingFiles)
+	files = slices.Compact(files)
+	data := new(bytes.Buffer)
+	for _, f := range files {
+		if f.Database != "" {
+			fmt.Fprintf(data, "%v\t", f.Database)
+		}
+		fmt.Fprintf(data, "%v\n", f.File)
+	}
+	if err := writeCacheFile(filepath.Join(ctx.cfg.CacheDir, failingFilesName), data.Bytes()); err != nil {
+		ctx.logger().Warn("failed to write failing files: "+err.Error(), "phase", "extract")
+	}
+}
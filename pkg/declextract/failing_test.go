@@ -0,0 +1,58 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailingFiles(t *testing.T) {
+	cacheDir := t.TempDir()
+	files, err := LoadFailingFiles(cacheDir)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	ctx := &context{cfg: &Config{CacheDir: cacheDir}}
+	a := FailingFile{File: "/linux/a.c"}
+	b := FailingFile{File: "/linux/b.c"}
+	// The same file in another build is recorded separately.
+	bExtra := FailingFile{Database: "/obj-extra/compile_commands.json", File: "/linux/b.c"}
+	c := FailingFile{File: "/linux/c.c"}
+	d := FailingFile{File: "/linux/d.c"}
+	ctx.updateFailingFiles(map[FailingFile]bool{b: false, a: false, c: true, bExtra: false})
+	files, err = LoadFailingFiles(cacheDir)
+	assert.NoError(t, err)
+	assert.Equal(t, []FailingFile{a, b, bExtra}, files)
+
+	ctx.updateFailingFiles(map[FailingFile]bool{a: true, d: false, bExtra: true})
+	files, err = LoadFailingFiles(cacheDir)
+	assert.NoError(t, err)
+	assert.Equal(t, []FailingFile{b, d}, files)
+	assert.Equal(t, "/linux/b.c (/obj-extra/compile_commands.json)", bExtra.String())
+}
+
+func TestFailingFilesParseError(t *testing.T) {
+	cacheDir := t.TempDir()
+	if err := writeCacheFile(filepath.Join(cacheDir, "fs", "read_write.c"), []byte("read(fd fd\n")); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &context{
+		cfg: &Config{
+			KernelSrc: "/linux",
+			KernelObj: "/linux",
+			// Outputs of the main build are cached in the top of the cache dir.
+			CompilationDatabase: "/linux/compile_commands.json",
+			CacheDir:            cacheDir,
+			CacheOnly:           true,
+			CompileCommands:     []CompileCommand{{File: "/linux/fs/read_write.c", Database: "/linux/compile_commands.json"}},
+		},
+	}
+	assert.Error(t, ctx.processFiles())
+	files, err := LoadFailingFiles(cacheDir)
+	assert.NoError(t, err)
+	assert.Equal(t, []FailingFile{{Database: "/linux/compile_commands.json", File: "/linux/fs/read_write.c"}}, files)
+}
@@ -0,0 +1,92 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/syzkaller/pkg/ast"
+	"github.com/google/syzkaller/pkg/osutil"
+)
+
+// CheckFixture runs extraction end-to-end on a fixture kernel and compares the results
+// with the golden files in the fixture dir (they are overwritten instead if update is set).
+// The fixture dir contains:
+//
+//	linux/                kernel sources (*.c.out files contain canned outputs of the binary)
+//	compile_commands.json compilation database ($KERNEL is replaced with the kernel sources dir)
+//	syz-declextract.sh    stub of the binary that prints the canned outputs
+//	sys/linux/            manual descriptions
+//	auto.txt.golden       expected descriptions (without the version)
+//	auto.txt.info.golden  expected interfaces
+//
+// See testdata/fixture for an example.
+func CheckFixture(dir string, update bool) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	kernel := filepath.Join(dir, "linux")
+	data, err := os.ReadFile(filepath.Join(dir, "compile_commands.json"))
+	if err != nil {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp("", "declextract-fixture")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	database := filepath.Join(tmpDir, "compile_commands.json")
+	if err := osutil.WriteFile(database, bytes.ReplaceAll(data, []byte("$KERNEL"), []byte(kernel))); err != nil {
+		return err
+	}
+	cmds, err := LoadCompileCommands(database, kernel, DefaultExcludePaths, "", nil)
+	if err != nil {
+		return err
+	}
+	res, err := Extract(&Config{
+		Binary:              filepath.Join(dir, "syz-declextract.sh"),
+		KernelSrc:           kernel,
+		KernelObj:           kernel,
+		CompilationDatabase: database,
+		CompileCommands:     cmds,
+		AutoFile:            filepath.Join(dir, "sys", "linux", "auto.txt"),
+	})
+	if err != nil {
+		return err
+	}
+	// The version depends on the syzkaller revision, so it's not a part of the golden files.
+	res.Descriptions.Nodes = slices.DeleteFunc(res.Descriptions.Nodes, func(node ast.Node) bool {
+		return versionComment(node) != ""
+	})
+	desc, err := FormatDescriptions(res.Descriptions)
+	if err != nil {
+		return err
+	}
+	for file, data := range map[string][]byte{
+		"auto.txt.golden":      desc,
+		"auto.txt.info.golden": SerializeInterfaces(res.Interfaces),
+	} {
+		file = filepath.Join(dir, file)
+		if update {
+			if err := osutil.WriteFile(file, data); err != nil {
+				return err
+			}
+			continue
+		}
+		want, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		if diff := cmp.Diff(string(want), string(data)); diff != "" {
+			return fmt.Errorf("%v does not match:\n%s", file, diff)
+		}
+	}
+	return nil
+}
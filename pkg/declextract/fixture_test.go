@@ -0,0 +1,18 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"flag"
+	"path/filepath"
+	"testing"
+)
+
+var flagUpdate = flag.Bool("update", false, "update golden files of the fixture")
+
+func TestFixture(t *testing.T) {
+	if err := CheckFixture(filepath.Join("testdata", "fixture"), *flagUpdate); err != nil {
+		t.Fatal(err)
+	}
+}
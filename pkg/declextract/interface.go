@@ -0,0 +1,401 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/google/syzkaller/pkg/ast"
+	"github.com/google/syzkaller/pkg/compiler"
+	"github.com/google/syzkaller/pkg/subsystem"
+)
+
+type Interface struct {
+	Type       string
+	Name       string
+	Files      []string
+	Func       string
+	Access     string
+	Subsystems []string
+	// One of Subsystems that most of Files belong to (set if Config.PrimarySubsystems is set).
+	PrimarySubsystem string
+	// Netlink family of NETLINK interfaces.
+	Family             string
+	ManualDescriptions bool
+	AutoDescriptions   bool
+
+	identifyingConst string
+}
+
+func (iface *Interface) ID() string {
+	return fmt.Sprintf("%v/%v", iface.Type, iface.Name)
+}
+
+func SerializeInterfaces(ifaces []Interface) []byte {
+	w := new(bytes.Buffer)
+	for _, iface := range ifaces {
+		fmt.Fprintf(w, "%v\t%v\tfunc:%v\taccess:%v\tmanual_desc:%v\tauto_desc:%v",
+			iface.Type, iface.Name, iface.Func, iface.Access,
+			iface.ManualDescriptions, iface.AutoDescriptions)
+		for _, file := range iface.Files {
+			fmt.Fprintf(w, "\tfile:%v", file)
+		}
+		for _, subsys := range iface.Subsystems {
+			fmt.Fprintf(w, "\tsubsystem:%v", subsys)
+		}
+		if iface.PrimarySubsystem != "" {
+			fmt.Fprintf(w, "\tprimary_subsystem:%v", iface.PrimarySubsystem)
+		}
+		if iface.Family != "" {
+			fmt.Fprintf(w, "\tfamily:%v", iface.Family)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+	return w.Bytes()
+}
+
+// interfaceFields are the fields that SerializeInterfaces writes for every interface.
+var interfaceFields = []string{"func", "access", "manual_desc", "auto_desc"}
+
+// ParseInterfaces parses interfaces serialized with SerializeInterfaces,
+// ParseInterfaces(SerializeInterfaces(ifaces)) returns the same interfaces.
+func ParseInterfaces(data []byte) ([]Interface, error) {
+	var ifaces []Interface
+	for i, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		iface, err := parseInterface(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", i+1, err)
+		}
+		ifaces = append(ifaces, iface)
+	}
+	return ifaces, nil
+}
+
+func parseInterface(line string) (Interface, error) {
+	fields := strings.Split(line, "\t")
+	if len(fields) < 2 || fields[0] == "" || fields[1] == "" {
+		return Interface{}, fmt.Errorf("want at least type and name, got %q", line)
+	}
+	iface := Interface{
+		Type: fields[0],
+		Name: fields[1],
+	}
+	seen := make(map[string]bool)
+	for _, field := range fields[2:] {
+		key, val, ok := strings.Cut(field, ":")
+		if !ok {
+			return Interface{}, fmt.Errorf("field %q is not in the key:value form", field)
+		}
+		if seen[key] && key != "file" && key != "subsystem" {
+			return Interface{}, fmt.Errorf("duplicate field %q", key)
+		}
+		seen[key] = true
+		var err error
+		switch key {
+		case "func":
+			iface.Func = val
+		case "access":
+			iface.Access = val
+		case "manual_desc":
+			iface.ManualDescriptions, err = strconv.ParseBool(val)
+		case "auto_desc":
+			iface.AutoDescriptions, err = strconv.ParseBool(val)
+		case "file":
+			iface.Files = append(iface.Files, val)
+		case "subsystem":
+			iface.Subsystems = append(iface.Subsystems, val)
+		case "primary_subsystem":
+			iface.PrimarySubsystem = val
+		case "family":
+			iface.Family = val
+		default:
+			err = fmt.Errorf("unknown field %q", key)
+		}
+		if err != nil {
+			return Interface{}, err
+		}
+	}
+	for _, key := range interfaceFields {
+		if !seen[key] {
+			return Interface{}, fmt.Errorf("missing field %q", key)
+		}
+	}
+	return iface, nil
+}
+
+// NewInterfaces returns interfaces that are not present in prev (interfaces are compared by ID).
+func NewInterfaces(prev, ifaces []Interface) []Interface {
+	known := make(map[string]bool)
+	for _, iface := range prev {
+		known[iface.ID()] = true
+	}
+	var res []Interface
+	for _, iface := range ifaces {
+		if !known[iface.ID()] {
+			res = append(res, iface)
+		}
+	}
+	return res
+}
+
+// finishInterfaces returns the sorted list of all interfaces.
+// The result must not depend on the order in which interfaces were merged.
+func (ctx *context) finishInterfaces() []Interface {
+	var interfaces []Interface
+	cache := make(map[string][]string)
+	incomplete := make(map[string][]string)
+	unmapped := make(map[string][]string)
+	for _, iface := range ctx.interfaces {
+		if ctx.cfg != nil && ctx.cfg.WarnIncomplete {
+			if fields := incompleteFields(iface); len(fields) != 0 {
+				incomplete[iface.Type] = append(incomplete[iface.Type],
+					fmt.Sprintf("%v (%v)", iface.Name, strings.Join(fields, ", ")))
+			}
+		}
+		iface.Files = slices.Clone(iface.Files)
+		slices.Sort(iface.Files)
+		iface.Files = slices.Compact(iface.Files)
+		if len(iface.Files) == 0 {
+			// Every INTERFACE comment is attributed to the file it was extracted from,
+			// so this means a bug in the interface merging logic.
+			ctx.warnf("finish", "", "interface %v has no files", iface.ID())
+		}
+		iface.Subsystems = ctx.fileSubsystems(iface.Files, cache)
+		if ctx.cfg != nil && ctx.cfg.PrimarySubsystems {
+			iface.PrimarySubsystem = ctx.primarySubsystem(iface.Files, iface.Subsystems, cache)
+		}
+		if iface.Access == "" {
+			iface.Access = "unknown"
+		} else if ctx.cfg != nil && ctx.cfg.AccessMap != nil {
+			if access, ok := ctx.cfg.AccessMap[iface.Access]; ok {
+				iface.Access = access
+			} else {
+				unmapped[iface.Access] = append(unmapped[iface.Access], iface.ID())
+			}
+		}
+		if iface.Type == "NETLINK" {
+			iface.Family = ctx.netlinkFamilies[iface.identifyingConst]
+		}
+		interfaces = append(interfaces, iface)
+	}
+	slices.SortFunc(interfaces, func(a, b Interface) int {
+		return strings.Compare(a.ID(), b.ID())
+	})
+	var accesses []string
+	for access := range unmapped {
+		accesses = append(accesses, access)
+	}
+	slices.Sort(accesses)
+	for _, access := range accesses {
+		ids := unmapped[access]
+		slices.Sort(ids)
+		ctx.warnf("finish", "", "access %q of %v interfaces is not in the access map: %v",
+			access, len(ids), strings.Join(ids, ", "))
+	}
+	var types []string
+	for typ := range incomplete {
+		types = append(types, typ)
+	}
+	slices.Sort(types)
+	for _, typ := range types {
+		names := incomplete[typ]
+		slices.Sort(names)
+		// These are not counted as warnings, since it's up to the binary to provide the data.
+		ctx.logger().Warn(fmt.Sprintf("%v %v interfaces have unspecified fields: %v",
+			len(names), typ, strings.Join(names, ", ")), "phase", "finish")
+	}
+	return interfaces
+}
+
+// ParseAccessMap parses a mapping of interface access levels to the canonical vocabulary
+// (one 'access canonical' pair per line, # starts a comment).
+func ParseAccessMap(data []byte) (map[string]string, error) {
+	accessMap := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %v: want access and canonical access, got %q", i+1, line)
+		}
+		if prev, ok := accessMap[fields[0]]; ok && prev != fields[1] {
+			return nil, fmt.Errorf("line %v: access %v is mapped to both %v and %v", i+1, fields[0], prev, fields[1])
+		}
+		accessMap[fields[0]] = fields[1]
+	}
+	return accessMap, nil
+}
+
+// incompleteFields returns names of key fields of the interface that were not specified
+// in any of the INTERFACE comments ("-" in the comments).
+func incompleteFields(iface Interface) []string {
+	var fields []string
+	if iface.Func == "" {
+		fields = append(fields, "func")
+	}
+	if iface.Access == "" {
+		fields = append(fields, "access")
+	}
+	if iface.identifyingConst == "" && interfacesWithConsts[iface.Type] {
+		fields = append(fields, "identifying const")
+	}
+	return fields
+}
+
+// SortInterfaces sorts interfaces by the key: "id" (the order used in Result.Interfaces),
+// "subsystem", "file" or "family" (interfaces with the same subsystems/files/netlink family are sorted by ID).
+func SortInterfaces(ifaces []Interface, key string) error {
+	var compare func(a, b *Interface) int
+	switch key {
+	case "id":
+	case "subsystem":
+		compare = func(a, b *Interface) int {
+			return slices.Compare(a.Subsystems, b.Subsystems)
+		}
+	case "file":
+		compare = func(a, b *Interface) int {
+			return slices.Compare(a.Files, b.Files)
+		}
+	case "family":
+		compare = func(a, b *Interface) int {
+			return strings.Compare(a.Family, b.Family)
+		}
+	default:
+		return fmt.Errorf("unknown interface sort key %q (id, subsystem, file or family)", key)
+	}
+	slices.SortFunc(ifaces, func(a, b Interface) int {
+		if compare != nil {
+			if res := compare(&a, &b); res != 0 {
+				return res
+			}
+		}
+		return strings.Compare(a.ID(), b.ID())
+	})
+	return nil
+}
+
+// fileSubsystems returns sorted names of subsystems for the sorted list of files.
+// Lots of interfaces come from the same files (e.g. all netlink commands of a family),
+// so results are cached by the list of files. Note: the subsystems can't be computed for each file
+// separately and then united, since the extractor votes on subsystems across all files.
+func (ctx *context) fileSubsystems(files []string, cache map[string][]string) []string {
+	if ctx.extractor == nil {
+		return nil
+	}
+	key := strings.Join(files, "\x00")
+	if subsystems, ok := cache[key]; ok {
+		return subsystems
+	}
+	var crashes []*subsystem.Crash
+	for _, file := range files {
+		crashes = append(crashes, &subsystem.Crash{GuiltyPath: file})
+	}
+	var subsystems []string
+	for _, s := range ctx.extractor.Extract(crashes) {
+		subsystems = append(subsystems, s.Name)
+	}
+	slices.Sort(subsystems)
+	subsystems = slices.Compact(subsystems)
+	cache[key] = subsystems
+	return subsystems
+}
+
+// primarySubsystem returns the subsystem (one of the sorted subsystems of the files)
+// that the largest number of the files belong to, ties are resolved by name.
+// The extractor does not rank subsystems, so files are attributed to subsystems one by one.
+func (ctx *context) primarySubsystem(files, subsystems []string, cache map[string][]string) string {
+	if len(subsystems) <= 1 {
+		return strings.Join(subsystems, "")
+	}
+	counts := make(map[string]int)
+	for _, file := range files {
+		for _, subsys := range ctx.fileSubsystems([]string{file}, cache) {
+			counts[subsys]++
+		}
+	}
+	primary := subsystems[0]
+	for _, subsys := range subsystems[1:] {
+		if counts[subsys] > counts[primary] {
+			primary = subsys
+		}
+	}
+	return primary
+}
+
+func (ctx *context) mergeInterface(iface Interface) error {
+	prev, ok := ctx.interfaces[iface.ID()]
+	if ok {
+		if iface.identifyingConst != prev.identifyingConst {
+			return fmt.Errorf("interface %v has different identifying consts: %v vs %v",
+				iface.ID(), iface.identifyingConst, prev.identifyingConst)
+		}
+		// Different files may disagree on the rest of the fields,
+		// choose a value that does not depend on the merge order.
+		iface.Func = mergeField(iface.Func, prev.Func)
+		iface.Access = mergeField(iface.Access, prev.Access)
+		iface.Files = append(slices.Clone(iface.Files), prev.Files...)
+	}
+	ctx.interfaces[iface.ID()] = iface
+	return nil
+}
+
+// mergeField returns the smallest non-empty value.
+func mergeField(a, b string) string {
+	if a == "" || b != "" && b < a {
+		return b
+	}
+	return a
+}
+
+// interfacesWithConsts are types of interfaces that are always identified by a const
+// (syscall number, ioctl command, netlink command, io_uring opcode).
+var interfacesWithConsts = map[string]bool{
+	"SYSCALL": true,
+	"IOCTL":   true,
+	"NETLINK": true,
+	"IOURING": true,
+}
+
+func (ctx *context) checkDescriptionPresence(interfaces []Interface, desc *ast.Description) error {
+	all, err := ctx.allDescriptions(desc)
+	if err != nil {
+		return err
+	}
+	consts := compiler.ExtractConsts(all, target, ctx.errorHandler("finish"))
+	auto := make(map[string]bool)
+	manual := make(map[string]bool)
+	for file, desc := range consts {
+		for _, c := range desc.Consts {
+			if file == ctx.cfg.AutoFile {
+				auto[c.Name] = true
+			} else {
+				manual[c.Name] = true
+			}
+		}
+	}
+	for i := range interfaces {
+		iface := &interfaces[i]
+		if iface.identifyingConst == "" && interfacesWithConsts[iface.Type] {
+			// Otherwise the interface would silently look undescribed.
+			ctx.warnf("finish", strings.Join(iface.Files, ","), "interface %v has no identifying const", iface.ID())
+			continue
+		}
+		if auto[iface.identifyingConst] {
+			iface.AutoDescriptions = true
+		}
+		if manual[iface.identifyingConst] {
+			iface.ManualDescriptions = true
+		}
+	}
+	return nil
+}
@@ -0,0 +1,311 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"bytes"
+	"log/slog"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/google/syzkaller/pkg/ast"
+	"github.com/google/syzkaller/pkg/osutil"
+	"github.com/google/syzkaller/pkg/subsystem"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFinishInterfacesDeterministic(t *testing.T) {
+	ifaces := []Interface{
+		{Type: "SYSCALL", Name: "read", Files: []string{"fs/read_write.c"}, Func: "ksys_read",
+			identifyingConst: "__NR_read"},
+		{Type: "SYSCALL", Name: "read", Files: []string{"fs/read_write.c"}, Func: "ksys_read",
+			Access: "user", identifyingConst: "__NR_read"},
+		{Type: "SYSCALL", Name: "read", Files: []string{"fs/compat.c"}, Func: "compat_read",
+			identifyingConst: "__NR_read"},
+		{Type: "IOCTL", Name: "FOO", Files: []string{"drivers/foo/foo.c"}, Func: "foo_ioctl",
+			Access: "admin", identifyingConst: "FOO"},
+		{Type: "IOCTL", Name: "FOO", Files: []string{"net/foo/foo.c"}, Func: "foo_ioctl",
+			Access: "user", identifyingConst: "FOO"},
+		{Type: "IOCTL", Name: "FOO", Files: []string{"drivers/foo/foo.c"}, Func: "foo_ioctl2",
+			identifyingConst: "FOO"},
+		{Type: "NETLINK", Name: "bar", Files: []string{"net/bar/bar.c"}, identifyingConst: "bar"},
+	}
+	extractor := subsystem.MakeExtractor(subsystem.GetList(target.OS))
+	var expect []byte
+	rnd := rand.New(rand.NewSource(0))
+	for i := 0; i < 20; i++ {
+		ctx := &context{
+			extractor:  extractor,
+			interfaces: make(map[string]Interface),
+		}
+		for _, idx := range rnd.Perm(len(ifaces)) {
+			iface := ifaces[idx]
+			iface.Files = slices.Clone(iface.Files)
+			if err := ctx.mergeInterface(iface); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got := SerializeInterfaces(ctx.finishInterfaces())
+		if i == 0 {
+			expect = got
+			continue
+		}
+		assert.Equal(t, string(expect), string(got))
+	}
+	assert.Equal(t, `IOCTL	FOO	func:foo_ioctl	access:admin	manual_desc:false	auto_desc:false`+
+		"\tfile:drivers/foo/foo.c\tfile:net/foo/foo.c\tsubsystem:net\n"+
+		`NETLINK	bar	func:	access:unknown	manual_desc:false	auto_desc:false`+
+		"\tfile:net/bar/bar.c\tsubsystem:net\n"+
+		`SYSCALL	read	func:compat_read	access:user	manual_desc:false	auto_desc:false`+
+		"\tfile:fs/compat.c\tfile:fs/read_write.c\tsubsystem:fs\n",
+		string(expect))
+}
+
+func TestInterfaceWithoutFiles(t *testing.T) {
+	ctx := &context{
+		extractor:  subsystem.MakeExtractor(subsystem.GetList(target.OS)),
+		interfaces: make(map[string]Interface),
+	}
+	for _, iface := range []Interface{
+		{Type: "IOCTL", Name: "FOO", Files: []string{"drivers/foo/foo.c"}, identifyingConst: "FOO"},
+		{Type: "IOCTL", Name: "BAR", identifyingConst: "BAR"},
+	} {
+		if err := ctx.mergeInterface(iface); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.Len(t, ctx.finishInterfaces(), 2)
+	assert.Equal(t, 1, ctx.warnings)
+}
+
+func TestInterfaceWithoutIdentifyingConst(t *testing.T) {
+	dir := t.TempDir()
+	autoFile := filepath.Join(dir, "auto.txt")
+	if err := osutil.WriteFile(filepath.Join(dir, "sys.txt"), []byte("foo()\n")); err != nil {
+		t.Fatal(err)
+	}
+	ctx := &context{
+		cfg:        &Config{AutoFile: autoFile},
+		extractor:  subsystem.MakeExtractor(subsystem.GetList(target.OS)),
+		interfaces: make(map[string]Interface),
+	}
+	comments := []string{
+		"INTERFACE: NETLINK NL80211_CMD_FOO - nl80211_foo CAP_NET_ADMIN",
+		"INTERFACE: NETLINK NL80211_CMD_BAR NL80211_CMD_BAR nl80211_bar CAP_NET_ADMIN",
+		"INTERFACE: FOO foo - - -",
+	}
+	for _, text := range comments {
+		if err := ctx.appendInterface(&ast.Comment{Text: text}, "net/wireless/nl80211.c"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	desc := &ast.Description{}
+	if err := ctx.checkDescriptionPresence(ctx.finishInterfaces(), desc); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, ctx.warnings)
+}
+
+func TestSortInterfaces(t *testing.T) {
+	ifaces := []Interface{
+		{Type: "SYSCALL", Name: "read", Files: []string{"fs/read_write.c"}, Subsystems: []string{"fs"}},
+		{Type: "NETLINK", Name: "CMD_FOO", Files: []string{"net/foo.c"}, Subsystems: []string{"net"}},
+		{Type: "SYSCALL", Name: "open", Files: []string{"fs/open.c"}, Subsystems: []string{"fs"}},
+		{Type: "SYSCALL", Name: "getpid", Files: []string{"kernel/sys.c"}},
+	}
+	ids := func() []string {
+		var res []string
+		for _, iface := range ifaces {
+			res = append(res, iface.ID())
+		}
+		return res
+	}
+	assert.NoError(t, SortInterfaces(ifaces, "id"))
+	assert.Equal(t, []string{"NETLINK/CMD_FOO", "SYSCALL/getpid", "SYSCALL/open", "SYSCALL/read"}, ids())
+	assert.NoError(t, SortInterfaces(ifaces, "subsystem"))
+	assert.Equal(t, []string{"SYSCALL/getpid", "SYSCALL/open", "SYSCALL/read", "NETLINK/CMD_FOO"}, ids())
+	assert.NoError(t, SortInterfaces(ifaces, "file"))
+	assert.Equal(t, []string{"SYSCALL/open", "SYSCALL/read", "SYSCALL/getpid", "NETLINK/CMD_FOO"}, ids())
+	assert.Error(t, SortInterfaces(ifaces, "name"))
+}
+
+func TestFileSubsystemsCache(t *testing.T) {
+	ctx := &context{
+		extractor: subsystem.MakeExtractor(subsystem.GetList(target.OS)),
+	}
+	cache := make(map[string][]string)
+	for _, files := range [][]string{
+		{"fs/ext4/ioctl.c"},
+		{"fs/ext4/ioctl.c", "net/core/sock.c"},
+		{"fs/ext4/ioctl.c"},
+		{"fs/ext4/ioctl.c", "net/core/sock.c"},
+	} {
+		want := ctx.fileSubsystems(files, make(map[string][]string))
+		assert.Equal(t, want, ctx.fileSubsystems(files, cache))
+	}
+	assert.Len(t, cache, 2)
+}
+
+func TestParseInterfaces(t *testing.T) {
+	ifaces := []Interface{
+		{Type: "SYSCALL", Name: "read", Files: []string{"fs/read_write.c"}, Func: "ksys_read",
+			Access: "unknown", Subsystems: []string{"fs", "vfs"}, ManualDescriptions: true},
+		{Type: "IOCTL", Name: "FOO", Files: []string{"drivers/a.c", "drivers/b.c"}, Func: "foo_ioctl",
+			Access: "user", AutoDescriptions: true},
+		{Type: "NETLINK", Name: "FOO_CMD", Files: []string{"net/foo.c"}, Access: "ns_admin",
+			Subsystems: []string{"net", "foo"}, PrimarySubsystem: "foo", Family: "FOO",
+			ManualDescriptions: true, AutoDescriptions: true},
+	}
+	parsed, err := ParseInterfaces(SerializeInterfaces(ifaces))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, ifaces, parsed)
+	for _, test := range []struct {
+		line string
+		err  string
+	}{
+		{"SYSCALL", `line 1: want at least type and name, got "SYSCALL"`},
+		{"SYSCALL\tread\tfoo:bar", `line 1: unknown field "foo"`},
+		{"SYSCALL\tread\tfunc", `line 1: field "func" is not in the key:value form`},
+		{"SYSCALL\tread\tfunc:a\tfunc:b", `line 1: duplicate field "func"`},
+		{"SYSCALL\tread\tfunc:a\taccess:user\tmanual_desc:false", `line 1: missing field "auto_desc"`},
+		{"SYSCALL\tread\tfunc:a\taccess:user\tmanual_desc:yes\tauto_desc:false",
+			`line 1: strconv.ParseBool: parsing "yes": invalid syntax`},
+	} {
+		_, err := ParseInterfaces([]byte(test.line + "\n"))
+		assert.EqualError(t, err, test.err, test.line)
+	}
+
+	added := NewInterfaces(parsed[:1], append(ifaces, Interface{Type: "SYSCALL", Name: "write"}))
+	var ids []string
+	for _, iface := range added {
+		ids = append(ids, iface.ID())
+	}
+	assert.Equal(t, []string{"IOCTL/FOO", "NETLINK/FOO_CMD", "SYSCALL/write"}, ids)
+}
+
+func TestPrimarySubsystem(t *testing.T) {
+	ctx := &context{
+		cfg: &Config{PrimarySubsystems: true},
+		extractor: subsystem.MakeExtractor([]*subsystem.Subsystem{
+			{Name: "aaa", PathRules: []subsystem.PathRule{{IncludeRegexp: "^a/"}}},
+			{Name: "zzz", PathRules: []subsystem.PathRule{{IncludeRegexp: "^z/"}}},
+		}),
+		interfaces: make(map[string]Interface),
+	}
+	for _, iface := range []Interface{
+		{Type: "IOCTL", Name: "FOO", Files: []string{"a/foo.c", "z/foo1.c", "z/foo2.c"}},
+		{Type: "IOCTL", Name: "BAR", Files: []string{"a/bar.c", "z/bar.c"}},
+		{Type: "IOCTL", Name: "BAZ", Files: []string{"z/baz.c"}},
+	} {
+		if err := ctx.mergeInterface(iface); err != nil {
+			t.Fatal(err)
+		}
+	}
+	interfaces := ctx.finishInterfaces()
+	primary := make(map[string]string)
+	for _, iface := range interfaces {
+		primary[iface.Name] = iface.PrimarySubsystem
+	}
+	assert.Equal(t, map[string]string{"FOO": "zzz", "BAR": "aaa", "BAZ": "zzz"}, primary)
+	parsed, err := ParseInterfaces(SerializeInterfaces(interfaces))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "zzz", parsed[2].PrimarySubsystem)
+}
+
+func TestWarnIncomplete(t *testing.T) {
+	logs := new(bytes.Buffer)
+	ctx := &context{
+		cfg: &Config{
+			WarnIncomplete: true,
+			Logger:         slog.New(slog.NewTextHandler(logs, nil)),
+		},
+		extractor:  subsystem.MakeExtractor(nil),
+		interfaces: make(map[string]Interface),
+	}
+	for _, iface := range []Interface{
+		{Type: "IOCTL", Name: "FOO", Files: []string{"a.c"}, Func: "foo_ioctl", Access: "user"},
+		{Type: "IOCTL", Name: "BAR", Files: []string{"a.c"}, Func: "bar_ioctl", identifyingConst: "BAR"},
+		// Distinct INTERFACE comments complement each other.
+		{Type: "IOCTL", Name: "BAZ", Files: []string{"a.c"}, Func: "baz_ioctl", identifyingConst: "BAZ"},
+		{Type: "IOCTL", Name: "BAZ", Files: []string{"b.c"}, Access: "user", identifyingConst: "BAZ"},
+		{Type: "FILEOP", Name: "foo_open", Files: []string{"a.c"}},
+	} {
+		if err := ctx.mergeInterface(iface); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx.finishInterfaces()
+	assert.Equal(t, 0, ctx.warnings)
+	assert.Contains(t, logs.String(), `msg="1 FILEOP interfaces have unspecified fields: foo_open (func, access)"`)
+	assert.Contains(t, logs.String(), `msg="2 IOCTL interfaces have unspecified fields:`+
+		` BAR (access), FOO (identifying const)"`)
+}
+
+func TestAccessMap(t *testing.T) {
+	accessMap, err := ParseAccessMap([]byte(`
+# Capabilities.
+CAP_NET_ADMIN	ns_admin
+CAP_SYS_ADMIN	root
+user		user # Kept as is.
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &context{
+		cfg: &Config{
+			AccessMap: accessMap,
+			Logger:    slog.New(slog.NewTextHandler(new(bytes.Buffer), nil)),
+		},
+		extractor:  subsystem.MakeExtractor(nil),
+		interfaces: make(map[string]Interface),
+	}
+	for _, iface := range []Interface{
+		{Type: "IOCTL", Name: "FOO", Files: []string{"a.c"}, Access: "CAP_SYS_ADMIN"},
+		{Type: "IOCTL", Name: "BAR", Files: []string{"a.c"}, Access: "CAP_NET_RAW"},
+		{Type: "NETLINK", Name: "BAZ", Files: []string{"a.c"}, Access: "CAP_NET_ADMIN"},
+		{Type: "SYSCALL", Name: "foo", Files: []string{"a.c"}, Access: "user"},
+		{Type: "SYSCALL", Name: "bar", Files: []string{"a.c"}},
+	} {
+		if err := ctx.mergeInterface(iface); err != nil {
+			t.Fatal(err)
+		}
+	}
+	access := make(map[string]string)
+	for _, iface := range ctx.finishInterfaces() {
+		access[iface.ID()] = iface.Access
+	}
+	assert.Equal(t, map[string]string{
+		"IOCTL/BAR":   "CAP_NET_RAW",
+		"IOCTL/FOO":   "root",
+		"NETLINK/BAZ": "ns_admin",
+		"SYSCALL/bar": "unknown",
+		"SYSCALL/foo": "user",
+	}, access)
+	// The unmapped CAP_NET_RAW access.
+	assert.Equal(t, 1, ctx.warnings)
+
+	_, err = ParseAccessMap([]byte("root\n"))
+	assert.ErrorContains(t, err, "line 1: want access and canonical access")
+	_, err = ParseAccessMap([]byte("root root\nroot admin\n"))
+	assert.ErrorContains(t, err, "line 2: access root is mapped to both root and admin")
+}
+
+func TestNoSubsystems(t *testing.T) {
+	ctx := &context{interfaces: make(map[string]Interface)}
+	iface := Interface{Type: "SYSCALL", Name: "foo", Files: []string{"fs/read_write.c"}, Access: "user"}
+	if err := ctx.mergeInterface(iface); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "SYSCALL\tfoo\tfunc:\taccess:user\tmanual_desc:false\tauto_desc:false\tfile:fs/read_write.c\n",
+		string(SerializeInterfaces(ctx.finishInterfaces())))
+
+	_, err := Extract(&Config{NoSubsystems: true, PrimarySubsystems: true})
+	assert.ErrorContains(t, err, "NoSubsystems can't be combined")
+}
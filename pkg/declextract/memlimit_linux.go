@@ -0,0 +1,13 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// setMemLimit limits the address space of the running process.
+func setMemLimit(pid int, limit uint64) error {
+	return unix.Prlimit(pid, unix.RLIMIT_AS, &unix.Rlimit{Cur: limit, Max: limit}, nil)
+}
@@ -0,0 +1,15 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+//go:build !linux
+
+package declextract
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func setMemLimit(pid int, limit uint64) error {
+	return fmt.Errorf("memory limit is not supported on %v", runtime.GOOS)
+}
@@ -0,0 +1,110 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"strings"
+
+	"github.com/google/syzkaller/pkg/ast"
+)
+
+// The binary describes each generic netlink family with a family id resource, a msghdr template type,
+// a syz_genetlink_get_family_id$auto_FAMILY call, and a sendmsg$auto_CMD call for each command:
+//
+//	sendmsg$auto_CMD(fd sock_nl_generic, msg ptr[in, msghdr_FAMILY_auto[CMD, POLICY]], f flags[send_flags])
+//
+// and emits a NETLINK interface for each command with the command as the identifying const.
+const (
+	netlinkGetFamilyPrefix = "syz_genetlink_get_family_id$auto_"
+	netlinkMsghdrPrefix    = "msghdr_"
+	netlinkMsghdrSuffix    = "_auto"
+)
+
+// netlinkCommand returns the command, family and attribute policy of a sendmsg$auto_CMD call.
+func netlinkCommand(call *ast.Call) (cmd, family, policy string, ok bool) {
+	if call.CallName != "sendmsg" || len(call.Args) < 2 {
+		return "", "", "", false
+	}
+	ptr := call.Args[1].Type
+	if ptr.Ident != "ptr" || len(ptr.Args) != 2 {
+		return "", "", "", false
+	}
+	msghdr := ptr.Args[1]
+	family, ok = strings.CutPrefix(msghdr.Ident, netlinkMsghdrPrefix)
+	if !ok || len(msghdr.Args) != 2 {
+		return "", "", "", false
+	}
+	family, ok = strings.CutSuffix(family, netlinkMsghdrSuffix)
+	if !ok || family == "" {
+		return "", "", "", false
+	}
+	return msghdr.Args[0].Ident, family, msghdr.Args[1].Ident, true
+}
+
+// netlinkFamily returns the netlink family the call belongs to, or "" if it's not a netlink call.
+func netlinkFamily(call *ast.Call) string {
+	if family, ok := strings.CutPrefix(call.Name.Name, netlinkGetFamilyPrefix); ok {
+		return family
+	}
+	_, family, _, _ := netlinkCommand(call)
+	return family
+}
+
+// recordNetlinkCommand remembers the family of the netlink command described by the call,
+// so that it can be attached to the NETLINK interface of the command.
+func (ctx *context) recordNetlinkCommand(call *ast.Call, file string) {
+	cmd, family, _, ok := netlinkCommand(call)
+	if !ok || cmd == "" {
+		return
+	}
+	if ctx.netlinkFamilies == nil {
+		ctx.netlinkFamilies = make(map[string]string)
+	}
+	if prev := ctx.netlinkFamilies[cmd]; prev != "" && prev != family {
+		ctx.warnf("parse", file, "netlink command %v belongs to families %v and %v", cmd, prev, family)
+		if prev < family {
+			return
+		}
+	}
+	ctx.netlinkFamilies[cmd] = family
+}
+
+// netlinkNodeFamilies returns the netlink families of nodes that belong to a single family:
+// the family calls and the attribute policies referenced only by commands of the family.
+func netlinkNodeFamilies(nodes []ast.Node) map[ast.Node]string {
+	families := make(map[ast.Node]string)
+	policies := make(map[string]string)
+	for _, node := range nodes {
+		call, ok := node.(*ast.Call)
+		if !ok {
+			continue
+		}
+		family := netlinkFamily(call)
+		if family == "" {
+			continue
+		}
+		families[node] = family
+		if _, _, policy, ok := netlinkCommand(call); ok && policy != "" {
+			if prev, ok := policies[policy]; ok && prev != family {
+				// Policies that are shared by several families stay where they are.
+				family = ""
+			}
+			policies[policy] = family
+		}
+	}
+	for _, node := range nodes {
+		switch n := node.(type) {
+		case *ast.Struct:
+			if family := policies[n.Name.Name]; family != "" {
+				families[node] = family
+			}
+		case *ast.TypeDef:
+			// Policies that could not be described are emitted as auto_todo typedefs.
+			if family := policies[n.Name.Name]; family != "" {
+				families[node] = family
+			}
+		}
+	}
+	return families
+}
@@ -0,0 +1,69 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"testing"
+
+	"github.com/google/syzkaller/pkg/ast"
+	"github.com/google/syzkaller/pkg/subsystem"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetlinkFamilies(t *testing.T) {
+	ctx := &context{
+		extractor: subsystem.MakeExtractor(nil),
+		syscallNameMap: map[string][]string{
+			"read":                        {"read"},
+			"sendmsg":                     {"sendmsg"},
+			"syz_genetlink_get_family_id": {"syz_genetlink_get_family_id"},
+		},
+		interfaces: make(map[string]Interface),
+	}
+	mustAppendNodes(t, ctx, parseNodes(t, `
+#INTERFACE: NETLINK ZZZ_CMD_A ZZZ_CMD_A zzz_a user
+#INTERFACE: NETLINK ZZZ_CMD_B ZZZ_CMD_B zzz_b user
+sendmsg$auto_ZZZ_CMD_A(fd sock_nl_generic, msg ptr[in, msghdr_ZZZ_auto[ZZZ_CMD_A, a_zzz_policy]], f flags[send_flags])
+sendmsg$auto_ZZZ_CMD_B(fd sock_nl_generic, msg ptr[in, msghdr_ZZZ_auto[ZZZ_CMD_B, shared_policy]], f flags[send_flags])
+syz_genetlink_get_family_id$auto_ZZZ(name ptr[in, string["ZZZ"]], fd sock_nl_generic) genl_ZZZ_family_id_auto
+a_zzz_policy [
+	a	int32
+]
+shared_policy [
+	a	int32
+]
+`), "net/zzz.c")
+	mustAppendNodes(t, ctx, parseNodes(t, `
+#INTERFACE: NETLINK AAA_CMD AAA_CMD aaa user
+sendmsg$auto_AAA_CMD(fd sock_nl_generic, msg ptr[in, msghdr_AAA_auto[AAA_CMD, shared_policy]], f flags[send_flags])
+syz_genetlink_get_family_id$auto_AAA(name ptr[in, string["AAA"]], fd sock_nl_generic) genl_AAA_family_id_auto
+read(fd fd)
+aaa_policy [
+	a	int32
+]
+`), "net/aaa.c")
+	families := make(map[string]string)
+	for _, iface := range ctx.finishInterfaces() {
+		families[iface.Name] = iface.Family
+	}
+	assert.Equal(t, map[string]string{"AAA_CMD": "AAA", "ZZZ_CMD_A": "ZZZ", "ZZZ_CMD_B": "ZZZ"}, families)
+
+	nodes := sortNodes(ctx.nodes)
+	assert.Equal(t, []string{
+		"read$auto",
+		"sendmsg$auto_AAA_CMD",
+		"syz_genetlink_get_family_id$auto_AAA",
+		"sendmsg$auto_ZZZ_CMD_A",
+		"sendmsg$auto_ZZZ_CMD_B",
+		"syz_genetlink_get_family_id$auto_ZZZ",
+	}, callNames(nodes))
+	var structs []string
+	for _, node := range nodes {
+		if str, ok := node.(*ast.Struct); ok {
+			structs = append(structs, str.Name.Name)
+		}
+	}
+	// Policies go after the rest, except for the shared policy that is not attributed to any family.
+	assert.Equal(t, []string{"aaa_policy", "shared_policy", "a_zzz_policy"}, structs)
+}
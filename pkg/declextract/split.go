@@ -0,0 +1,159 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/google/syzkaller/pkg/ast"
+	"github.com/google/syzkaller/pkg/compiler"
+)
+
+// SplitBySubsystem returns parts of the descriptions related to each subsystem: calls that correspond
+// to interfaces of the subsystem (the call uses the identifying const of the interface), and the nodes
+// that are still used with only these calls (see removeUnused). Defines are present in the parts
+// that refer to them, and annotations of calls in the parts with the calls. The rest of unnamed nodes
+// (e.g. includes) are present in the parts with nodes from the same files according to Result.Provenance,
+// or in all parts if the provenance is unknown. Config.AutoFile is used to find the rest of descriptions.
+func SplitBySubsystem(cfg *Config, res *Result) (map[string]*ast.Description, error) {
+	ctx := &context{cfg: cfg}
+	desc := res.Descriptions
+	subsystems := make(map[string][]string)
+	for _, iface := range res.Interfaces {
+		if iface.identifyingConst != "" {
+			subsystems[iface.identifyingConst] = append(subsystems[iface.identifyingConst], iface.Subsystems...)
+		}
+	}
+	calls := make(map[string]map[string]bool)
+	for _, node := range desc.Nodes {
+		call, ok := node.(*ast.Call)
+		if !ok {
+			continue
+		}
+		for _, name := range callConsts(call) {
+			for _, subsys := range subsystems[name] {
+				if calls[subsys] == nil {
+					calls[subsys] = make(map[string]bool)
+				}
+				calls[subsys][call.Name.Name] = true
+			}
+		}
+	}
+	var names []string
+	var subsets []func(*ast.Call) bool
+	for subsys, subsysCalls := range calls {
+		names = append(names, subsys)
+		subsets = append(subsets, func(call *ast.Call) bool {
+			// Manual descriptions are present in all parts.
+			return call.Pos.File != cfg.AutoFile || subsysCalls[call.Name.Name]
+		})
+	}
+	all, err := ctx.allDescriptions(desc)
+	if err != nil {
+		return nil, err
+	}
+	unusedNodes, err := compiler.CollectUnusedSubsets(all, target, ctx.errorHandler("finish"), subsets)
+	if err != nil {
+		return nil, fmt.Errorf("failed to typecheck descriptions: %w", err)
+	}
+	parts := make(map[string]*ast.Description)
+	for i, subsys := range names {
+		unused := make(map[string]bool)
+		for _, n := range unusedNodes[i] {
+			if pos, _, _ := n.Info(); pos.File == cfg.AutoFile {
+				unused[nodeKey(n)] = true
+			}
+		}
+		parts[subsys] = splitPart(desc, res.Provenance, func(node ast.Node) bool {
+			if call, ok := node.(*ast.Call); ok {
+				return calls[subsys][call.Name.Name]
+			}
+			return !unused[nodeKey(node)]
+		})
+	}
+	return parts, nil
+}
+
+// splitPart returns the part of the descriptions with the named nodes that are kept,
+// and the unnamed nodes and defines they need (see SplitBySubsystem).
+func splitPart(desc *ast.Description, provenance map[ast.Node][]string, keep func(ast.Node) bool) *ast.Description {
+	kept := make(map[ast.Node]bool)
+	files := make(map[string]bool)
+	var defines []*ast.Define
+	for _, node := range desc.Nodes {
+		if define, ok := node.(*ast.Define); ok {
+			defines = append(defines, define)
+			continue
+		}
+		if _, _, name := node.Info(); name != "" && keep(node) {
+			kept[node] = true
+			for _, file := range provenance[node] {
+				files[file] = true
+			}
+		}
+	}
+	idents := make(map[string]bool)
+	for node := range kept {
+		refIdents(node, idents)
+	}
+	// Defines may refer to other defines.
+	for changed := true; changed; {
+		changed = false
+		for _, define := range defines {
+			if !kept[define] && idents[define.Name.Name] {
+				kept[define] = true
+				refIdents(define, idents)
+				changed = true
+			}
+		}
+	}
+	part := &ast.Description{}
+	for i, node := range desc.Nodes {
+		if _, ok := node.(*ast.NewLine); ok {
+			continue
+		}
+		if _, _, name := node.Info(); name == "" {
+			if annotationComment(node) {
+				// Annotations precede their calls.
+				if i+1 == len(desc.Nodes) || !kept[desc.Nodes[i+1]] {
+					continue
+				}
+			} else if nodeFiles := provenance[node]; len(nodeFiles) != 0 &&
+				!slices.ContainsFunc(nodeFiles, func(file string) bool { return files[file] }) {
+				continue
+			}
+		} else if !kept[node] {
+			continue
+		}
+		part.Nodes = append(part.Nodes, node)
+	}
+	return part
+}
+
+// callConsts returns consts the call refers to (some of them may be identifying consts of interfaces),
+// syscalls refer to their __NR_ consts.
+func callConsts(call *ast.Call) []string {
+	idents := map[string]bool{"__NR_" + call.CallName: true}
+	refIdents(call, idents)
+	var res []string
+	for name := range idents {
+		res = append(res, name)
+	}
+	slices.Sort(res)
+	return res
+}
+
+// refIdents adds the identifiers the node refers to (types and consts) to the set.
+func refIdents(node ast.Node, idents map[string]bool) {
+	ast.Recursive(func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.Type:
+			idents[n.Ident] = true
+		case *ast.Int:
+			idents[n.Ident] = true
+		}
+		return true
+	})(node)
+}
@@ -0,0 +1,124 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/syzkaller/pkg/ast"
+	"github.com/google/syzkaller/pkg/osutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitBySubsystem(t *testing.T) {
+	dir := t.TempDir()
+	if err := osutil.WriteFile(filepath.Join(dir, "sys.txt"), []byte("resource fd[int32]\nclose(fd fd)\n")); err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		AutoFile: filepath.Join(dir, "auto.txt"),
+		Logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+	}
+	desc := &ast.Description{Nodes: parseNodes(t, `
+include <include/uapi/linux/fs.h>
+include <include/uapi/linux/io_uring.h>
+
+define FOO_FLAG1 1
+
+foo_flags = FOO_FLAG1, 2
+
+resource fd_foo[fd]
+
+# subsystem: fs, file: fs/read_write.c
+read$auto(fd fd, buf ptr[out, read_buf$auto])
+# subsystem: foo fs, file: fs/open.c
+open$auto(file ptr[in, filename], flags flags[foo_flags]) fd_foo
+# subsystem: foo, file: net/foo.c
+sendmsg$auto_FOO_CMD(fd fd_foo, msg ptr[in, foo_msg$auto[FOO_CMD]])
+# subsystem: io_uring, file: io_uring/rw.c
+io_uring_enter$auto_IORING_OP_READ(fd fd, op const[IORING_OP_READ])
+
+read_buf$auto {
+	a	int32
+}
+
+type foo_msg$auto[CMD] {
+	cmd	const[CMD, int32]
+	a	foo_nested$auto
+}
+
+foo_nested$auto {
+	a	const[FOO_FLAG1, int32]
+}
+`)}
+	files := map[string][]string{
+		"include <include/uapi/linux/fs.h>":       {"fs/open.c", "fs/read_write.c"},
+		"include <include/uapi/linux/io_uring.h>": {"io_uring/rw.c"},
+		"read$auto":                          {"fs/read_write.c"},
+		"open$auto":                          {"fs/open.c"},
+		"sendmsg$auto_FOO_CMD":               {"net/foo.c"},
+		"io_uring_enter$auto_IORING_OP_READ": {"io_uring/rw.c"},
+	}
+	provenance := make(map[ast.Node][]string)
+	for _, node := range desc.Nodes {
+		key := strings.TrimSpace(string(ast.SerializeNode(node)))
+		if _, _, name := node.Info(); name != "" {
+			key = name
+		}
+		provenance[node] = files[key]
+	}
+	interfaces := []Interface{
+		{Type: "SYSCALL", Name: "read", Subsystems: []string{"fs"}, identifyingConst: "__NR_read"},
+		{Type: "SYSCALL", Name: "open", Subsystems: []string{"fs", "foo"}, identifyingConst: "__NR_open"},
+		{Type: "NETLINK", Name: "FOO_CMD", Subsystems: []string{"foo"}, identifyingConst: "FOO_CMD"},
+		{Type: "IOURING", Name: "IORING_OP_READ", Subsystems: []string{"io_uring"},
+			identifyingConst: "IORING_OP_READ"},
+	}
+	split, err := SplitBySubsystem(cfg, &Result{Descriptions: desc, Interfaces: interfaces, Provenance: provenance})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := make(map[string]string)
+	for subsys, part := range split {
+		parts[subsys] = string(ast.Format(part))
+	}
+	assert.Equal(t, map[string]string{
+		"fs": `include <include/uapi/linux/fs.h>
+define FOO_FLAG1	1
+foo_flags = FOO_FLAG1, 2
+resource fd_foo[fd]
+# subsystem: fs, file: fs/read_write.c
+read$auto(fd fd, buf ptr[out, read_buf$auto])
+# subsystem: foo fs, file: fs/open.c
+open$auto(file ptr[in, filename], flags flags[foo_flags]) fd_foo
+read_buf$auto {
+	a	int32
+}
+`,
+		"foo": `include <include/uapi/linux/fs.h>
+define FOO_FLAG1	1
+foo_flags = FOO_FLAG1, 2
+resource fd_foo[fd]
+# subsystem: foo fs, file: fs/open.c
+open$auto(file ptr[in, filename], flags flags[foo_flags]) fd_foo
+# subsystem: foo, file: net/foo.c
+sendmsg$auto_FOO_CMD(fd fd_foo, msg ptr[in, foo_msg$auto[FOO_CMD]])
+type foo_msg$auto[CMD] {
+	cmd	const[CMD, int32]
+	a	foo_nested$auto
+}
+foo_nested$auto {
+	a	const[FOO_FLAG1, int32]
+}
+`,
+		"io_uring": `include <include/uapi/linux/io_uring.h>
+# subsystem: io_uring, file: io_uring/rw.c
+io_uring_enter$auto_IORING_OP_READ(fd fd, op const[IORING_OP_READ])
+`,
+	}, parts)
+}
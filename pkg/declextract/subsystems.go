@@ -0,0 +1,148 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+
+	"github.com/google/syzkaller/pkg/subsystem"
+)
+
+// LoadSubsystems loads the list of subsystems from a JSON file that looks as follows:
+//
+//	[
+//		{"name": "fs", "paths": [{"include": "^fs/", "exclude": "^fs/ext4/"}]},
+//		{"name": "ext4", "paths": [{"include": "^fs/ext4/"}], "parents": ["fs"]}
+//	]
+//
+// Path rules are regexps matched against file paths relative to the kernel source dir.
+func LoadSubsystems(file string) ([]*subsystem.Subsystem, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var entries []struct {
+		Name  string `json:"name"`
+		Paths []struct {
+			Include string `json:"include"`
+			Exclude string `json:"exclude"`
+		} `json:"paths"`
+		Parents []string `json:"parents"`
+	}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse %v: %w", file, err)
+	}
+	var list []*subsystem.Subsystem
+	byName := make(map[string]*subsystem.Subsystem)
+	for _, entry := range entries {
+		if entry.Name == "" || byName[entry.Name] != nil {
+			return nil, fmt.Errorf("%v: empty or duplicate subsystem name %q", file, entry.Name)
+		}
+		s := &subsystem.Subsystem{Name: entry.Name}
+		for _, path := range entry.Paths {
+			for _, re := range []string{path.Include, path.Exclude} {
+				if _, err := regexp.Compile(re); err != nil {
+					return nil, fmt.Errorf("%v: subsystem %v: %w", file, entry.Name, err)
+				}
+			}
+			s.PathRules = append(s.PathRules, subsystem.PathRule{
+				IncludeRegexp: path.Include,
+				ExcludeRegexp: path.Exclude,
+			})
+		}
+		byName[s.Name] = s
+		list = append(list, s)
+	}
+	for i, entry := range entries {
+		for _, name := range entry.Parents {
+			parent := byName[name]
+			if parent == nil {
+				return nil, fmt.Errorf("%v: subsystem %v: unknown parent %q", file, entry.Name, name)
+			}
+			list[i].Parents = append(list[i].Parents, parent)
+		}
+	}
+	return list, nil
+}
+
+// subsystemList returns the subsystems, or the built-in list for the target OS if subsystems is nil.
+// The built-in list is empty for OSes without subsystem definitions.
+func subsystemList(subsystems []*subsystem.Subsystem) []*subsystem.Subsystem {
+	if subsystems == nil {
+		subsystems = subsystem.GetList(target.OS)
+	}
+	return subsystems
+}
+
+// RefreshSubsystems recomputes subsystems of the interfaces (e.g. parsed from an existing info file)
+// with the subsystems (the built-in list for the target OS if nil), so that the info file can be
+// updated after the subsystem definitions change without extracting the kernel again.
+// Primary subsystems are recomputed if primary is set and are cleared otherwise.
+// Problems are logged to the logger (slog.Default() if nil), and the number of them is returned.
+func RefreshSubsystems(ifaces []Interface, subsystems []*subsystem.Subsystem, primary bool,
+	logger *slog.Logger) (warnings int) {
+	ctx := &context{cfg: &Config{Logger: logger}}
+	subsystems = subsystemList(subsystems)
+	if len(subsystems) == 0 {
+		ctx.warnf("finish", "", "no subsystems are defined for %v, interfaces are not attributed to subsystems",
+			target.OS)
+	}
+	ctx.extractor = subsystem.MakeExtractor(subsystems)
+	cache := make(map[string][]string)
+	for i := range ifaces {
+		iface := &ifaces[i]
+		// Files are sorted in the info file, as fileSubsystems expects.
+		iface.Subsystems = ctx.fileSubsystems(iface.Files, cache)
+		iface.PrimarySubsystem = ""
+		if primary {
+			iface.PrimarySubsystem = ctx.primarySubsystem(iface.Files, iface.Subsystems, cache)
+		}
+	}
+	return ctx.warnings
+}
+
+// LimitPerSubsystem keeps at most limit commands for each subsystem in the order of cmds (so they need
+// to be shuffled first to get a random sample). Files are attributed to subsystems (Config.Subsystems,
+// or the built-in list for the target OS if nil) in the same way as interfaces, with paths relative
+// to the source and build dirs of cfg (see RelativePath). Files without subsystems are limited
+// as a separate group. Files of several subsystems count towards all of them,
+// and they are kept if any of the subsystems has not reached the limit yet.
+// Problems are logged to Config.Logger, and the number of them is returned.
+func LimitPerSubsystem(cfg *Config, cmds []CompileCommand, limit int) (res []CompileCommand, warnings int) {
+	ctx := &context{cfg: cfg}
+	subsystems := subsystemList(cfg.Subsystems)
+	if len(subsystems) == 0 {
+		ctx.warnf("load", "", "no subsystems are defined for %v, all files are limited as one group", target.OS)
+	}
+	extractor := subsystem.MakeExtractor(subsystems)
+	counts := make(map[string]int)
+	for _, cmd := range cmds {
+		file := cmd.File
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(cmd.Directory, file)
+		}
+		file, _ = ctx.sourcePath(file)
+		names := []string{""}
+		if extracted := extractor.Extract([]*subsystem.Crash{{GuiltyPath: file}}); len(extracted) != 0 {
+			names = nil
+			for _, s := range extracted {
+				names = append(names, s.Name)
+			}
+		}
+		if !slices.ContainsFunc(names, func(name string) bool { return counts[name] < limit }) {
+			continue
+		}
+		for _, name := range names {
+			counts[name]++
+		}
+		res = append(res, cmd)
+	}
+	return res, ctx.warnings
+}
@@ -0,0 +1,166 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/syzkaller/pkg/osutil"
+	"github.com/google/syzkaller/pkg/subsystem"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSubsystems(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "subsystems.json")
+	data := `[
+	{"name": "fs", "paths": [{"include": "^fs/", "exclude": "^fs/ext4/"}]},
+	{"name": "ext4", "paths": [{"include": "^fs/ext4/"}], "parents": ["fs"]},
+	{"name": "foo", "paths": [{"include": "^drivers/foo/"}]}
+]`
+	if err := osutil.WriteFile(file, []byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	list, err := LoadSubsystems(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &context{
+		extractor:  subsystem.MakeExtractor(list),
+		interfaces: make(map[string]Interface),
+	}
+	for _, iface := range []Interface{
+		{Type: "SYSCALL", Name: "read", Files: []string{"fs/read_write.c"}, identifyingConst: "__NR_read"},
+		{Type: "IOCTL", Name: "EXT4", Files: []string{"fs/ext4/ioctl.c"}, identifyingConst: "EXT4"},
+		{Type: "IOCTL", Name: "FOO", Files: []string{"drivers/foo/foo.c"}, identifyingConst: "FOO"},
+		{Type: "IOCTL", Name: "BAR", Files: []string{"drivers/bar/bar.c"}, identifyingConst: "BAR"},
+	} {
+		if err := ctx.mergeInterface(iface); err != nil {
+			t.Fatal(err)
+		}
+	}
+	subsystems := make(map[string][]string)
+	for _, iface := range ctx.finishInterfaces() {
+		subsystems[iface.ID()] = iface.Subsystems
+	}
+	assert.Equal(t, map[string][]string{
+		"SYSCALL/read": {"fs"},
+		"IOCTL/EXT4":   {"ext4"},
+		"IOCTL/FOO":    {"foo"},
+		"IOCTL/BAR":    nil,
+	}, subsystems)
+
+	for _, data := range []string{
+		`[{"name": "fs", "paths": [{"include": "^fs/("}]}]`,
+		`[{"name": "fs"}, {"name": "fs"}]`,
+		`[{"name": "ext4", "parents": ["fs"]}]`,
+	} {
+		if err := osutil.WriteFile(file, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadSubsystems(file)
+		assert.Error(t, err, "data: %v", data)
+	}
+}
+
+func TestLimitPerSubsystem(t *testing.T) {
+	subsystems := []*subsystem.Subsystem{
+		{Name: "fs", PathRules: []subsystem.PathRule{{IncludeRegexp: "^fs/"}}},
+		{Name: "net", PathRules: []subsystem.PathRule{{IncludeRegexp: "^net/"}}},
+		{Name: "tcp", PathRules: []subsystem.PathRule{{IncludeRegexp: "^net/ipv4/tcp"}}},
+	}
+	var cmds []CompileCommand
+	for _, file := range []string{"fs/a.c", "net/a.c", "fs/b.c", "net/ipv4/tcp.c", "fs/c.c",
+		"net/b.c", "lib/a.c", "lib/b.c"} {
+		cmds = append(cmds, CompileCommand{File: filepath.Join("/linux", file)})
+	}
+	var files []string
+	limited, warnings := LimitPerSubsystem(&Config{KernelSrc: "/linux", Subsystems: subsystems}, cmds, 2)
+	assert.Equal(t, 0, warnings)
+	for _, cmd := range limited {
+		files = append(files, cmd.File)
+	}
+	// net/b.c is dropped since tcp.c counts as a net file as well.
+	assert.Equal(t, []string{"/linux/fs/a.c", "/linux/net/a.c", "/linux/fs/b.c", "/linux/net/ipv4/tcp.c",
+		"/linux/lib/a.c", "/linux/lib/b.c"}, files)
+
+	// Generated files of the build dirs are attributed by their paths relative to the build dirs,
+	// files outside of all dirs don't belong to any subsystem.
+	cmds = []CompileCommand{
+		{File: "/obj-extra/net/gen.c"},
+		{File: "/linux/net/a.c"},
+		{File: "fs/gen.c", Directory: "/obj"},
+		{File: "/linux/fs/a.c"},
+		{File: "/other/a.c"},
+		{File: "/linux/lib/a.c"},
+	}
+	cfg := &Config{
+		KernelSrc:      "/linux",
+		KernelObj:      "/obj",
+		ExtraKernelObj: []string{"/obj-extra"},
+		Subsystems:     subsystems,
+	}
+	files = nil
+	limited, _ = LimitPerSubsystem(cfg, cmds, 1)
+	for _, cmd := range limited {
+		files = append(files, cmd.File)
+	}
+	assert.Equal(t, []string{"/obj-extra/net/gen.c", "fs/gen.c", "/other/a.c"}, files)
+}
+
+func TestRefreshSubsystems(t *testing.T) {
+	ifaces, err := ParseInterfaces([]byte(
+		"IOCTL\tFOO\tfunc:foo\taccess:user\tmanual_desc:false\tauto_desc:true" +
+			"\tfile:drivers/foo/a.c\tfile:fs/b.c\tfile:fs/c.c\tsubsystem:old\tprimary_subsystem:old\n" +
+			"SYSCALL\tread\tfunc:ksys_read\taccess:unknown\tmanual_desc:true\tauto_desc:false" +
+			"\tfile:mm/read.c\tsubsystem:old\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subsystems := []*subsystem.Subsystem{
+		{Name: "fs", PathRules: []subsystem.PathRule{{IncludeRegexp: "^fs/"}}},
+		{Name: "foo", PathRules: []subsystem.PathRule{{IncludeRegexp: "^drivers/foo/"}}},
+	}
+	assert.Equal(t, 0, RefreshSubsystems(ifaces, subsystems, true, nil))
+	assert.Equal(t, []string{"foo", "fs"}, ifaces[0].Subsystems)
+	assert.Equal(t, "fs", ifaces[0].PrimarySubsystem)
+	assert.Empty(t, ifaces[1].Subsystems)
+	assert.Empty(t, ifaces[1].PrimarySubsystem)
+
+	assert.Equal(t, 0, RefreshSubsystems(ifaces, subsystems, false, nil))
+	assert.Empty(t, ifaces[0].PrimarySubsystem)
+}
+
+func TestEmptySubsystems(t *testing.T) {
+	for _, noSubsystems := range []bool{false, true} {
+		logs := new(bytes.Buffer)
+		cfg := &Config{
+			NoSubsystems: noSubsystems,
+			Logger:       slog.New(slog.NewTextHandler(logs, nil)),
+		}
+		if !noSubsystems {
+			cfg.Subsystems = []*subsystem.Subsystem{}
+		}
+		// Extraction fails later since there is no binary.
+		_, err := Extract(cfg)
+		assert.Error(t, err)
+		assert.Equal(t, !noSubsystems, strings.Contains(logs.String(), "no subsystems are defined"), logs.String())
+	}
+}
+
+func TestEmptySubsystemsWarnings(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ifaces := []Interface{{Type: "SYSCALL", Name: "read", Files: []string{"fs/read_write.c"}}}
+	assert.Equal(t, 1, RefreshSubsystems(ifaces, []*subsystem.Subsystem{}, false, logger))
+	assert.Empty(t, ifaces[0].Subsystems)
+	cmds := []CompileCommand{{File: "/linux/fs/a.c"}, {File: "/linux/fs/b.c"}}
+	cfg := &Config{KernelSrc: "/linux", KernelObj: "/linux", Subsystems: []*subsystem.Subsystem{}, Logger: logger}
+	limited, warnings := LimitPerSubsystem(cfg, cmds, 1)
+	assert.Equal(t, 1, warnings)
+	assert.Len(t, limited, 1)
+}
@@ -0,0 +1,616 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/syzkaller/pkg/ast"
+	"github.com/google/syzkaller/sys/targets"
+)
+
+func (ctx *context) renameSyscall(syscall *ast.Call, file string) []ast.Node {
+	names, variant := ctx.syscallNameMap[syscall.CallName], "$auto"
+	if compat := ctx.compatNameMap[syscall.CallName]; len(compat) != 0 {
+		names, variant = compat, "$compat"
+	}
+	if len(names) == 0 {
+		// Syscall has no record in the tables for the architectures we support.
+		return nil
+	}
+	suffix, ok := callVariant(syscall)
+	if !ok {
+		ctx.warnf("parse", file, "call %v does not match its syscall %v", syscall.Name.Name, syscall.CallName)
+	}
+	if suffix != "" {
+		variant = suffix
+	}
+	var renamed []ast.Node
+	for _, name := range names {
+		newCall := syscall.Clone().(*ast.Call)
+		newCall.Name.Name = name + variant
+		newCall.CallName = name // Not required	but avoids mistakenly treating CallName as the part before the $.
+		renamed = append(renamed, newCall)
+	}
+
+	return renamed
+}
+
+// callVariant returns the variant of the call including the $ (empty for calls without a variant,
+// e.g. SYSCALL_DEFINE0 functions are emitted as "getpid()"). If the name does not have the form
+// CallName[$variant], the variant after the first $ in the name (if any) is returned, and ok is false.
+func callVariant(call *ast.Call) (variant string, ok bool) {
+	rest, found := strings.CutPrefix(call.Name.Name, call.CallName)
+	if found && (rest == "" || rest[0] == '$') {
+		return rest, true
+	}
+	if _, v, found := strings.Cut(call.Name.Name, "$"); found {
+		return "$" + v, false
+	}
+	return "", false
+}
+
+// validateCalls warns about calls that are not backed by any syscall table entry or rename,
+// this indicates a bug in the renaming logic.
+func (ctx *context) validateCalls(desc *ast.Description) {
+	known := make(map[string]bool)
+	for _, names := range ctx.syscallNameMap {
+		for _, name := range names {
+			known[name] = true
+		}
+	}
+	for _, names := range ctx.compatNameMap {
+		for _, name := range names {
+			known[name] = true
+		}
+	}
+	for _, node := range desc.Nodes {
+		if call, ok := node.(*ast.Call); ok && !known[call.CallName] {
+			ctx.warnf("finish", "", "call %v is not present in the syscall tables", call.Name.Name)
+		}
+	}
+}
+
+//go:embed skip_syscalls.txt
+var defaultSkipSyscalls string
+
+// ParseSyscallList parses a list of syscall names (one per line, # starts a comment).
+func ParseSyscallList(data []byte) map[string]bool {
+	syscalls := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		if line = strings.TrimSpace(line); line != "" {
+			syscalls[line] = true
+		}
+	}
+	return syscalls
+}
+
+type syscallDesc struct {
+	fn      string
+	compat  string
+	arch    string
+	is64bit bool
+	table   string
+	nr      uint64
+	// The number is not valid or belongs to an ABI group we don't fuzz.
+	untargeted bool
+	// Syzkaller arch the syscall number applies to (empty if it's not known).
+	syzArch string
+}
+
+//go:embed rename_syscalls.txt
+var defaultRenameSyscalls string
+
+// ParseRenameList parses a list of function renames (see rename_syscalls.txt for the format).
+func ParseRenameList(data []byte) (map[string][]string, error) {
+	renames := make(map[string][]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %v: want function and call name, got %q", i+1, line)
+		}
+		renames[fields[0]] = append(renames[fields[0]], fields[1])
+	}
+	return renames, nil
+}
+
+// skipSyscallList returns the default list of skipped syscalls merged with the list from cfg.
+func skipSyscallList(cfg *Config) map[string]bool {
+	skip := ParseSyscallList([]byte(defaultSkipSyscalls))
+	maps.Copy(skip, cfg.SkipSyscalls)
+	return skip
+}
+
+// renameList returns the default list of function renames merged with the list from cfg.
+func renameList(cfg *Config) (map[string][]string, error) {
+	renames, err := ParseRenameList([]byte(defaultRenameSyscalls))
+	if err != nil {
+		return nil, fmt.Errorf("bad rename_syscalls.txt: %w", err)
+	}
+	mergeRenames(renames, cfg.RenameSyscalls)
+	return renames, nil
+}
+
+// mergeRenames adds function renames to the syscall name map.
+func mergeRenames(syscallNameMap, renames map[string][]string) {
+	for fn, names := range renames {
+		for _, name := range names {
+			if !slices.Contains(syscallNameMap[fn], name) {
+				syscallNameMap[fn] = append(syscallNameMap[fn], name)
+			}
+		}
+		slices.Sort(syscallNameMap[fn])
+	}
+}
+
+// DumpSyscallMap returns the mapping of functions to syscall names used by Extract for cfg
+// in human-readable form. For each syscall it shows the table entry that was preferred,
+// and the entries for other arches that were considered.
+func DumpSyscallMap(cfg *Config) ([]byte, error) {
+	skip := skipSyscallList(cfg)
+	ctx := &context{cfg: cfg}
+	syscalls, err := ctx.readSyscallDescs(skip)
+	if err != nil {
+		return nil, err
+	}
+	renames, err := renameList(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for syscall, descs := range syscalls {
+		line := fmt.Sprintf("%v -> %v (%v)", descs[0].fn, syscall, formatSyscallDesc(cfg, descs[0]))
+		if len(descs) > 1 {
+			var others []string
+			for _, desc := range descs[1:] {
+				others = append(others, fmt.Sprintf("%v (%v)", desc.fn, formatSyscallDesc(cfg, desc)))
+			}
+			line += fmt.Sprintf(", other candidates: %v", strings.Join(others, ", "))
+		}
+		lines = append(lines, line)
+	}
+	for fn, names := range renames {
+		for _, name := range names {
+			lines = append(lines, fmt.Sprintf("%v -> %v (rename list)", fn, name))
+		}
+	}
+	slices.Sort(lines)
+	lines = slices.Compact(lines)
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+// AmbiguousSyscalls returns syscalls that have candidate table entries with different functions
+// in human-readable form (one per line). For each syscall it shows the entry that was preferred,
+// and the entries with other functions that lost.
+func AmbiguousSyscalls(cfg *Config) ([]byte, error) {
+	ctx := &context{cfg: cfg}
+	syscalls, err := ctx.readSyscallDescs(skipSyscallList(cfg))
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for syscall, descs := range syscalls {
+		var others []string
+		for _, desc := range descs[1:] {
+			if desc.fn != descs[0].fn {
+				others = append(others, fmt.Sprintf("%v (%v)", desc.fn, formatSyscallDesc(cfg, desc)))
+			}
+		}
+		if len(others) != 0 {
+			lines = append(lines, fmt.Sprintf("%v: %v (%v) wins over %v", syscall, descs[0].fn,
+				formatSyscallDesc(cfg, descs[0]), strings.Join(slices.Compact(others), ", ")))
+		}
+	}
+	if len(lines) == 0 {
+		return nil, nil
+	}
+	slices.Sort(lines)
+	return []byte(strings.Join(lines, "\n") + "\n"), nil
+}
+
+func formatSyscallDesc(cfg *Config, desc syscallDesc) string {
+	table, _ := filepath.Rel(cfg.KernelSrc, desc.table)
+	res := table
+	if desc.arch != "" {
+		res += ", arch " + desc.arch
+	}
+	if desc.is64bit {
+		res += ", 64-bit"
+	}
+	if desc.compat != "" {
+		res += ", compat " + desc.compat
+	}
+	return res
+}
+
+// readSyscallMap returns mapping of functions defined with SYSCALL_DEFINE macros to actual syscall names,
+// and the same mapping for functions defined with COMPAT_SYSCALL_DEFINE macros (with "compat_" prefix).
+func (ctx *context) readSyscallMap(skip map[string]bool) (map[string][]string, map[string][]string, error) {
+	syscalls, err := ctx.readSyscallDescs(skip)
+	if err != nil {
+		return nil, nil, err
+	}
+	ctx.syscallDescs = syscalls
+	rename := make(map[string][]string)
+	compat := make(map[string][]string)
+	for syscall, descs := range syscalls {
+		fn := descs[0].fn
+		rename[fn] = append(rename[fn], syscall)
+		for _, desc := range descs {
+			if desc.compat != "" {
+				compat[desc.compat] = append(compat[desc.compat], syscall)
+				break
+			}
+		}
+	}
+	// The lists are built in the map order, calls are renamed in the order of the lists.
+	for _, m := range []map[string][]string{rename, compat} {
+		for _, names := range m {
+			slices.Sort(names)
+		}
+	}
+	return rename, compat, nil
+}
+
+// readSyscallDescs returns table entries for each syscall, the preferred entry goes first.
+func (ctx *context) readSyscallDescs(skip map[string]bool) (map[string][]syscallDesc, error) {
+	// Parse syscall tables that map functions defined with SYSCALL_DEFINE macros to actual syscall names.
+	// Total mapping is many-to-many, so we give preference to x86 arch, then to 64-bit syscalls,
+	// and then just order arches and functions by name to have deterministic result.
+	// Tables are read in parallel by Config.Concurrency workers,
+	// the order in which they are read does not affect the result.
+	tables, err := ctx.syscallTables()
+	if err != nil {
+		return nil, err
+	}
+	var (
+		mu         sync.Mutex
+		wg         sync.WaitGroup
+		read       int
+		unreadable int
+		syscalls   = make(map[string][]syscallDesc)
+	)
+	workers := min(ctx.concurrency(), len(tables))
+	tableQueue := make(chan syscallTable, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for table := range tableQueue {
+				tableSyscalls, err := ctx.readSyscallTable(table, skip)
+				mu.Lock()
+				if err != nil {
+					unreadable++
+					ctx.warnf("load", table.path, "skipping unreadable syscall table: %v", err)
+				} else {
+					read++
+					for syscall, descs := range tableSyscalls {
+						syscalls[syscall] = append(syscalls[syscall], descs...)
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, table := range tables {
+		tableQueue <- table
+	}
+	close(tableQueue)
+	wg.Wait()
+	// Remaining tables usually provide enough mapping, so we fail only if none of them can be read.
+	if read == 0 && unreadable != 0 {
+		return nil, fmt.Errorf("none of %v syscall tables in %v could be read", unreadable, ctx.cfg.KernelSrc)
+	}
+
+	for _, descs := range syscalls {
+		slices.SortFunc(descs, func(a, b syscallDesc) int {
+			if (a.arch == target.Arch) != (b.arch == target.Arch) {
+				if a.arch == target.Arch {
+					return -1
+				}
+				return 1
+			}
+			if a.is64bit != b.is64bit {
+				if a.is64bit {
+					return -1
+				}
+				return 1
+			}
+			if a.arch != b.arch {
+				return strings.Compare(a.arch, b.arch)
+			}
+			if a.fn != b.fn {
+				return strings.Compare(a.fn, b.fn)
+			}
+			return strings.Compare(a.compat, b.compat)
+		})
+	}
+	return syscalls, nil
+}
+
+// syscallTable is a syscall table file to read.
+type syscallTable struct {
+	path string
+	// The arch the table belongs to (nil for tables in Config.SyscallTables that are not used by any arch).
+	arch *targets.Target
+	// ABI groups of a generic table that are used by the arch (all groups are used if nil).
+	abis map[string]bool
+}
+
+// syscallTables returns the syscall tables to read for cfg: .tbl files in the arch dirs and
+// the generic tables the arches use instead (see syscallTableIndirection), unless
+// cfg.OnlySyscallTables is set, and the files matching cfg.SyscallTables.
+func (ctx *context) syscallTables() ([]syscallTable, error) {
+	cfg := ctx.cfg
+	var tables []syscallTable
+	seen := make(map[string]bool)
+	add := func(table syscallTable) {
+		key := table.path
+		if table.arch != nil {
+			key += "\x00" + table.arch.Arch
+		}
+		if !seen[key] {
+			seen[key] = true
+			tables = append(tables, table)
+		}
+	}
+	var arches []*targets.Target
+	for _, arch := range targets.List[target.OS] {
+		arches = append(arches, arch)
+	}
+	slices.SortFunc(arches, func(a, b *targets.Target) int {
+		return strings.Compare(a.Arch, b.Arch)
+	})
+	generic := make(map[*targets.Target]syscallTable)
+	for _, arch := range arches {
+		if table, ok := ctx.syscallTableIndirection(arch); ok {
+			generic[arch] = table
+		}
+	}
+	if !cfg.OnlySyscallTables {
+		for _, arch := range arches {
+			// The generic table goes first, so that the ABI groups of the arch are respected
+			// if the arch dir contains the table as well.
+			if table, ok := generic[arch]; ok {
+				add(table)
+			}
+			// Walk errors are ignored b/c not all arch dirs are present in all kernel trees.
+			filepath.Walk(filepath.Join(cfg.KernelSrc, "arch", arch.KernelHeaderArch),
+				func(path string, info fs.FileInfo, err error) error {
+					if err == nil && strings.HasSuffix(path, ".tbl") {
+						add(syscallTable{path: path, arch: arch})
+					}
+					return err
+				})
+		}
+	}
+	for _, glob := range cfg.SyscallTables {
+		if !filepath.IsAbs(glob) {
+			glob = filepath.Join(cfg.KernelSrc, glob)
+		}
+		files, err := filepath.Glob(glob)
+		if err != nil {
+			return nil, fmt.Errorf("bad syscall table glob %q: %w", glob, err)
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("syscall table glob %q matches no files", glob)
+		}
+		for _, file := range files {
+			// Tables in arch dirs belong to all arches that use the dir,
+			// and generic tables belong to the arches that use them.
+			var dir string
+			if rel, err := filepath.Rel(cfg.KernelSrc, file); err == nil {
+				if rest, ok := strings.CutPrefix(filepath.ToSlash(rel), "arch/"); ok {
+					dir, _, _ = strings.Cut(rest, "/")
+				}
+			}
+			attributed := false
+			for _, arch := range arches {
+				if table, ok := generic[arch]; ok && table.path == file {
+					add(table)
+					attributed = true
+				} else if dir != "" && arch.KernelHeaderArch == dir {
+					add(syscallTable{path: file, arch: arch})
+					attributed = true
+				}
+			}
+			if !attributed {
+				add(syscallTable{path: file})
+			}
+		}
+	}
+	return tables, nil
+}
+
+// syscallTableIndirection returns the generic syscall table used by the arch along with the ABI groups
+// of the table the arch uses. Arches that use the generic scripts/syscall.tbl table (or provide their
+// own tables in the same format) don't have .tbl files in the arch dir, instead they describe
+// the table in kernel/Makefile.syscalls that looks as follows (see scripts/Makefile.asm-headers):
+//
+//	syscall_abis_64 += renameat rlimit memfd_secret
+//	syscalltbl = arch/arm64/tools/syscall_%.tbl
+//
+// The syscalltbl line is optional (scripts/syscall.tbl is used by default), % is replaced with 32 or 64.
+func (ctx *context) syscallTableIndirection(arch *targets.Target) (syscallTable, bool) {
+	sourceDir := ctx.cfg.KernelSrc
+	makefile := filepath.Join(sourceDir, "arch", arch.KernelHeaderArch, "kernel", "Makefile.syscalls")
+	data, err := os.ReadFile(makefile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ctx.warnf("load", makefile, "skipping unreadable syscall makefile: %v", err)
+		}
+		return syscallTable{}, false
+	}
+	bits := fmt.Sprint(arch.PtrSize * 8)
+	table := syscallTable{
+		path: filepath.Join(sourceDir, "scripts", "syscall.tbl"),
+		arch: arch,
+		abis: map[string]bool{"common": true, bits: true},
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		fields := strings.Fields(line)
+		if len(fields) < 2 || fields[1] != "=" && fields[1] != ":=" && fields[1] != "+=" {
+			continue
+		}
+		switch fields[0] {
+		case "syscall_abis_" + bits:
+			for _, abi := range fields[2:] {
+				table.abis[abi] = true
+			}
+		case "syscalltbl":
+			if len(fields) == 3 {
+				file := strings.ReplaceAll(fields[2], "%", bits)
+				file = strings.TrimPrefix(file, "$(srctree)/")
+				table.path = filepath.Join(sourceDir, filepath.FromSlash(file))
+			}
+		}
+	}
+	return table, true
+}
+
+// syscallGroups says if syscalls in the ABI group of a syscall table are 64-bit.
+var syscallGroups = map[string]bool{
+	"common": true,
+	"64":     true,
+	"n64":    true,
+	"nospu":  true,
+	"32":     false,
+	"x32":    false,
+	"i386":   false,
+	"n32":    false,
+	"o32":    false,
+	"eabi":   false,
+	"oabi":   false,
+	"spu":    false,
+}
+
+// archSyscallGroups are ABI groups that are 32-bit on the arch regardless of syscallGroups
+// (e.g. arm tables have only common, oabi and eabi groups).
+var archSyscallGroups = map[string]map[string]bool{
+	targets.ARM: {"common": true, "oabi": true, "eabi": true},
+}
+
+// untargetedSyscallGroups are ABI groups of syscall tables that don't correspond to any syzkaller arch.
+var untargetedSyscallGroups = map[string]bool{
+	"x32":  true,
+	"n32":  true,
+	"o32":  true,
+	"oabi": true,
+}
+
+// checkSyscallNumbers checks that __NR_ consts of the syscall interfaces match
+// the syscall numbers in the tables for all arches the numbers are known for.
+func (ctx *context) checkSyscallNumbers(interfaces []Interface, syscalls map[string][]syscallDesc) {
+	archConsts := make(map[string]map[string]uint64)
+	for _, iface := range interfaces {
+		if iface.Type != "SYSCALL" {
+			continue
+		}
+		for _, desc := range syscalls[iface.Name] {
+			if desc.syzArch == "" {
+				continue
+			}
+			if archConsts[desc.syzArch] == nil {
+				archConsts[desc.syzArch] = ctx.cfg.SyscallConsts.Arch(desc.syzArch)
+			}
+			val, ok := archConsts[desc.syzArch][iface.identifyingConst]
+			if ok && val != desc.nr {
+				table, _ := filepath.Rel(ctx.cfg.KernelSrc, desc.table)
+				ctx.warnf("finish", strings.Join(iface.Files, ","),
+					"syscall %v (func %v) has number %v in %v, but %v is %v on %v",
+					iface.Name, iface.Func, desc.nr, table, iface.identifyingConst, val, desc.syzArch)
+			}
+		}
+	}
+}
+
+// readSyscallTable parses the syscall table file.
+// Lines in the files look as follows:
+//
+//	288      common  accept4                 sys_accept4
+//
+// Some lines additionally contain the compat entry point:
+//
+//	3        i386    read                    sys_read                compat_sys_read
+func (ctx *context) readSyscallTable(table syscallTable, skip map[string]bool) (map[string][]syscallDesc, error) {
+	f, err := os.Open(table.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	arch := ""
+	if table.arch != nil {
+		arch = table.arch.VMArch
+	}
+	syscalls := make(map[string][]syscallDesc)
+	unknownGroups := make(map[string]bool)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 4 || fields[0] == "#" {
+			continue
+		}
+		group := fields[1]
+		syscall := fields[2]
+		fn := strings.TrimPrefix(fields[3], "sys_")
+		if strings.HasPrefix(syscall, "unused") || fn == "-" ||
+			// Powerpc spu group defines some syscalls (utimesat)
+			// that are not present on any of our arches.
+			group == "spu" ||
+			// Generic tables contain syscalls of all arches.
+			table.abis != nil && !table.abis[group] ||
+			// See skip_syscalls.txt for the default list.
+			skip[syscall] {
+			continue
+		}
+		is64bit, known := syscallGroups[group]
+		if table.arch != nil && archSyscallGroups[table.arch.Arch][group] {
+			is64bit, known = false, true
+		}
+		if table.abis != nil {
+			// ABI groups of generic tables are arch features rather than ABIs (e.g. renameat).
+			is64bit, known = table.arch.PtrSize == 8, true
+		}
+		if !known && !unknownGroups[group] {
+			unknownGroups[group] = true
+			ctx.warnf("load", table.path, "unknown syscall table group %q, assuming it's 32-bit", group)
+		}
+		nr, err := strconv.ParseUint(fields[0], 0, 64)
+		compat := ""
+		if len(fields) > 4 && strings.HasPrefix(fields[4], "compat_sys_") {
+			compat = "compat_" + strings.TrimPrefix(fields[4], "compat_sys_")
+		}
+		desc := syscallDesc{
+			fn:      fn,
+			compat:  compat,
+			arch:    arch,
+			is64bit: is64bit,
+			table:   table.path,
+			nr:      nr,
+			// Numbers in ABI groups we don't fuzz would be compared against wrong arches.
+			untargeted: err != nil || untargetedSyscallGroups[group],
+		}
+		if table.arch != nil && !desc.untargeted && desc.is64bit == (table.arch.PtrSize == 8) {
+			desc.syzArch = table.arch.Arch
+		}
+		syscalls[syscall] = append(syscalls[syscall], desc)
+	}
+	return syscalls, s.Err()
+}
@@ -0,0 +1,469 @@
+// Copyright 2024 syzkaller project authors. All rights reserved.
+// Use of this source code is governed by Apache 2 LICENSE that can be found in the LICENSE file.
+
+package declextract
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/syzkaller/pkg/ast"
+	"github.com/google/syzkaller/pkg/compiler"
+	"github.com/google/syzkaller/pkg/osutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipSyscalls(t *testing.T) {
+	dir := t.TempDir()
+	writeSyscallTable(t, dir, "x86", `
+0	common	read	sys_read
+1	common	write	sys_write
+169	common	reboot	sys_reboot
+`)
+	skip := ParseSyscallList([]byte(defaultSkipSyscalls))
+	maps.Copy(skip, ParseSyscallList([]byte("# comment\nwrite\n")))
+	syscallNameMap, _, err := (&context{cfg: &Config{KernelSrc: dir}}).readSyscallMap(skip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &context{
+		syscallNameMap: syscallNameMap,
+		interfaces:     make(map[string]Interface),
+	}
+	mustAppendNodes(t, ctx, parseNodes(t, `
+read(fd fd)
+write(fd fd)
+reboot(magic int32)
+`), "fs/read_write.c")
+	assert.Equal(t, []string{"read$auto"}, callNames(ctx.nodes))
+}
+
+func TestSyscallMapTieBreak(t *testing.T) {
+	dir := t.TempDir()
+	writeSyscallTable(t, dir, "x86", `
+0	common	foo	sys_foo_b
+1	64	foo	sys_foo_a
+2	common	bar	sys_bar
+`)
+	for i := 0; i < 10; i++ {
+		rename, _, err := (&context{cfg: &Config{KernelSrc: dir}}).readSyscallMap(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []string{"foo"}, rename["foo_a"])
+		assert.Empty(t, rename["foo_b"])
+		assert.Equal(t, []string{"bar"}, rename["bar"])
+	}
+}
+
+func TestRenameOrder(t *testing.T) {
+	dir := t.TempDir()
+	writeSyscallTable(t, dir, "x86", `
+0	64	zzz	sys_shared
+1	64	aaa	sys_shared
+2	64	mmm	sys_shared
+`)
+	// Calls are renamed in the same order regardless of the map order (before nodes are sorted).
+	for i := 0; i < 10; i++ {
+		rename, _, err := (&context{cfg: &Config{KernelSrc: dir}}).readSyscallMap(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx := &context{
+			syscallNameMap: rename,
+			interfaces:     make(map[string]Interface),
+		}
+		mustAppendNodes(t, ctx, parseNodes(t, "shared(fd fd)\n"), "fs/shared.c")
+		assert.Equal(t, []string{"aaa$auto", "mmm$auto", "zzz$auto"}, callNames(ctx.nodes))
+	}
+}
+
+func TestCompatSyscalls(t *testing.T) {
+	dir := t.TempDir()
+	writeSyscallTable(t, dir, "x86", `
+3	i386	read	sys_read	compat_sys_read
+4	i386	write	sys_write
+`)
+	syscallNameMap, compatNameMap, err := (&context{cfg: &Config{KernelSrc: dir}}).readSyscallMap(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, map[string][]string{"compat_read": {"read"}}, compatNameMap)
+	nodes := `
+read(fd fd)
+compat_read(fd fd)
+write(fd fd)
+`
+	ctx := &context{
+		syscallNameMap: syscallNameMap,
+		interfaces:     make(map[string]Interface),
+	}
+	mustAppendNodes(t, ctx, parseNodes(t, nodes), "fs/read_write.c")
+	assert.Equal(t, []string{"read$auto", "write$auto"}, callNames(ctx.nodes))
+	ctx.nodes = nil
+	ctx.compatNameMap = compatNameMap
+	mustAppendNodes(t, ctx, parseNodes(t, nodes), "fs/read_write.c")
+	assert.Equal(t, []string{"read$auto", "read$compat", "write$auto"}, callNames(ctx.nodes))
+}
+
+func TestSyscallMapArches(t *testing.T) {
+	dir := t.TempDir()
+	writeSyscallTable(t, dir, "x86", `
+0	common	read	sys_read
+1	common	write	sys_write	compat_sys_write
+`)
+	writeSyscallTable(t, dir, "arm64", `
+63	common	read	sys_read_arm64
+64	common	write	sys_write_arm64
+65	common	readv	sys_readv	compat_sys_readv
+`)
+	writeSyscallTable(t, dir, "s390", `
+3	common	read	sys_read_s390
+145	common	readv	sys_readv_s390	compat_sys_readv_s390
+`)
+	// Arches are read in parallel, the result must not depend on the order or the number of workers.
+	for i := 0; i < 10; i++ {
+		rename, compat, err := (&context{cfg: &Config{KernelSrc: dir, Concurrency: i % 3}}).readSyscallMap(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, map[string][]string{
+			"read":  {"read"},
+			"write": {"write"},
+			"readv": {"readv"},
+		}, rename)
+		assert.Equal(t, map[string][]string{
+			"compat_write": {"write"},
+			"compat_readv": {"readv"},
+		}, compat)
+	}
+}
+
+func TestRenameSyscalls(t *testing.T) {
+	dir := t.TempDir()
+	writeSyscallTable(t, dir, "x86", `
+0	common	read	sys_read
+`)
+	syscallNameMap, _, err := (&context{cfg: &Config{KernelSrc: dir}}).readSyscallMap(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaults, err := ParseRenameList([]byte(defaultRenameSyscalls))
+	if err != nil {
+		t.Fatal(err)
+	}
+	custom, err := ParseRenameList([]byte(`
+# comment
+syz_foo	syz_foo_bar
+syz_foo	syz_foo_baz
+read	read_alias
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mergeRenames(syscallNameMap, defaults)
+	mergeRenames(syscallNameMap, custom)
+	ctx := &context{
+		syscallNameMap: syscallNameMap,
+		interfaces:     make(map[string]Interface),
+	}
+	mustAppendNodes(t, ctx, parseNodes(t, `
+read(fd fd)
+syz_foo(fd fd)
+syz_genetlink_get_family_id(name ptr[in, string])
+`), "fs/read_write.c")
+	assert.Equal(t, []string{"read$auto", "read_alias$auto", "syz_foo_bar$auto", "syz_foo_baz$auto",
+		"syz_genetlink_get_family_id$auto"}, callNames(ctx.nodes))
+
+	_, err = ParseRenameList([]byte("syz_foo\n"))
+	assert.Error(t, err)
+}
+
+func TestDumpSyscallMap(t *testing.T) {
+	dir := t.TempDir()
+	writeSyscallTable(t, dir, "x86", `
+0	64	foo	sys_foo
+1	common	bar	sys_bar
+`)
+	writeSyscallTable(t, dir, "arm64", `
+0	common	foo	sys_foo2
+`)
+	data, err := DumpSyscallMap(&Config{
+		KernelSrc:      dir,
+		RenameSyscalls: map[string][]string{"baz": {"baz2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(string(data), "\n")
+	x86 := "arch/x86/entry/syscalls/syscall_64.tbl"
+	arm64 := "arch/arm64/entry/syscalls/syscall_64.tbl"
+	assert.Contains(t, lines, "foo -> foo ("+x86+", arch amd64, 64-bit), other candidates:"+
+		" foo ("+x86+", 64-bit), foo2 ("+arm64+", 64-bit)")
+	assert.Contains(t, lines, "bar -> bar ("+x86+", arch amd64, 64-bit), other candidates: bar ("+x86+", 64-bit)")
+	assert.Contains(t, lines, "baz -> baz2 (rename list)")
+}
+
+func TestAmbiguousSyscalls(t *testing.T) {
+	dir := t.TempDir()
+	writeSyscallTable(t, dir, "x86", `
+0	64	foo	sys_foo
+1	common	bar	sys_bar
+`)
+	writeSyscallTable(t, dir, "arm64", `
+0	common	foo	sys_foo2
+1	common	bar	sys_bar
+`)
+	data, err := AmbiguousSyscalls(&Config{KernelSrc: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "foo: foo (arch/x86/entry/syscalls/syscall_64.tbl, arch amd64, 64-bit) wins over"+
+		" foo2 (arch/arm64/entry/syscalls/syscall_64.tbl, 64-bit)\n", string(data))
+}
+
+func TestSyscallGroups(t *testing.T) {
+	dir := t.TempDir()
+	writeSyscallTable(t, dir, "x86", `
+0	x32	foo	sys_afoo
+1	64	foo	sys_foo
+2	x32	bar	sys_bar_x32
+3	common	bar	sys_bar
+4	weird	baz	sys_baz_weird
+`)
+	file := filepath.Join(dir, "arch", "x86", "entry", "syscalls", "syscall_64.tbl")
+	ctx := &context{}
+	syscalls, err := ctx.readSyscallTable(syscallTable{path: file, arch: target}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The weird group.
+	assert.Equal(t, 1, ctx.warnings)
+	for syscall, descs := range syscalls {
+		for _, desc := range descs {
+			assert.Equal(t, desc.fn == syscall, desc.is64bit, "%v: %+v", syscall, desc)
+		}
+	}
+	rename, _, err := (&context{cfg: &Config{KernelSrc: dir}}).readSyscallMap(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"foo"}, rename["foo"])
+	assert.Equal(t, []string{"bar"}, rename["bar"])
+	assert.Empty(t, rename["afoo"])
+	assert.Empty(t, rename["bar_x32"])
+}
+
+func TestValidateCalls(t *testing.T) {
+	ctx := &context{
+		syscallNameMap: map[string][]string{"read": {"read"}, "llseek": {"_llseek"}},
+		compatNameMap:  map[string][]string{"compat_write": {"write"}},
+	}
+	desc := &ast.Description{Nodes: parseNodes(t, `
+read$auto(fd fd)
+_llseek$auto(fd fd)
+write$compat(fd fd)
+llseek$auto(fd fd)
+`)}
+	ctx.validateCalls(desc)
+	assert.Equal(t, 1, ctx.warnings)
+}
+
+func TestCheckSyscallNumbers(t *testing.T) {
+	dir := t.TempDir()
+	writeSyscallTable(t, dir, "x86", `
+0	common	read	sys_read
+1	64	write	sys_write
+2	64	open	sys_open
+512	x32	ioctl	compat_sys_ioctl
+`)
+	constFile := filepath.Join(dir, "sys.txt.const")
+	if err := osutil.WriteFile(constFile, []byte(`
+arches = 386, amd64
+__NR_read = 0
+__NR_write = 4
+__NR_ioctl = 16
+`)); err != nil {
+		t.Fatal(err)
+	}
+	consts := compiler.DeserializeConstFile(constFile, nil)
+	if consts == nil {
+		t.Fatal("failed to parse consts")
+	}
+	ctx := &context{cfg: &Config{KernelSrc: dir, SyscallConsts: consts}}
+	syscalls, err := ctx.readSyscallDescs(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var interfaces []Interface
+	for _, name := range []string{"read", "write", "open", "ioctl"} {
+		interfaces = append(interfaces, Interface{Type: "SYSCALL", Name: name, identifyingConst: "__NR_" + name})
+	}
+	ctx.checkSyscallNumbers(interfaces, syscalls)
+	// Only write mismatches: open has no const, and ioctl is in the x32 group.
+	assert.Equal(t, 1, ctx.warnings)
+}
+
+func TestCheckSyscallNumbersArm(t *testing.T) {
+	dir := t.TempDir()
+	writeSyscallTable(t, dir, "arm", `
+3	common	read	sys_read
+4	eabi	write	sys_write
+5	oabi	open	sys_open
+`)
+	constFile := filepath.Join(dir, "sys.txt.const")
+	if err := osutil.WriteFile(constFile, []byte(`
+arches = arm
+__NR_read = 0
+__NR_write = 1
+__NR_open = 2
+`)); err != nil {
+		t.Fatal(err)
+	}
+	consts := compiler.DeserializeConstFile(constFile, nil)
+	if consts == nil {
+		t.Fatal("failed to parse consts")
+	}
+	ctx := &context{cfg: &Config{KernelSrc: dir, SyscallConsts: consts}}
+	syscalls, err := ctx.readSyscallDescs(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var interfaces []Interface
+	for _, name := range []string{"read", "write", "open"} {
+		interfaces = append(interfaces, Interface{Type: "SYSCALL", Name: name, identifyingConst: "__NR_" + name})
+	}
+	ctx.checkSyscallNumbers(interfaces, syscalls)
+	// The common and eabi groups are checked against arm, oabi is not fuzzed.
+	assert.Equal(t, 2, ctx.warnings)
+}
+
+func TestCallVariant(t *testing.T) {
+	ctx := &context{
+		syscallNameMap: map[string][]string{"getpid": {"getpid"}, "read": {"read"}, "setuid16": {"setuid"}},
+		interfaces:     make(map[string]Interface),
+	}
+	mustAppendNodes(t, ctx, parseNodes(t, `
+getpid()
+getpid$foo()
+setuid16(uid int32)
+`), "kernel/sys.c")
+	mismatching := []*ast.Call{
+		// Doesn't start with the call name at all.
+		{Name: &ast.Ident{Name: "foo"}, CallName: "read"},
+		// Starts with the call name, but it's a different syscall.
+		{Name: &ast.Ident{Name: "readv$bar"}, CallName: "read"},
+	}
+	for _, call := range mismatching {
+		mustAppendNodes(t, ctx, []ast.Node{call}, "fs/read_write.c")
+	}
+	assert.Equal(t, 2, ctx.warnings)
+	assert.Equal(t, []string{"getpid$auto", "getpid$foo", "setuid$auto", "read$auto", "read$bar"},
+		callNames(ctx.nodes))
+}
+
+func TestUnreadableSyscallTable(t *testing.T) {
+	dir := t.TempDir()
+	writeSyscallTable(t, dir, "x86", `
+0	common	read	sys_read
+`)
+	unreadable := filepath.Join(dir, "arch", "arm64", "entry", "syscalls", "syscall_64.tbl")
+	if err := osutil.MkdirAll(filepath.Dir(unreadable)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "nonexistent"), unreadable); err != nil {
+		t.Fatal(err)
+	}
+	syscallNameMap, _, err := (&context{cfg: &Config{KernelSrc: dir}}).readSyscallMap(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"read"}, syscallNameMap["read"])
+
+	if err := os.RemoveAll(filepath.Join(dir, "arch", "x86")); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = (&context{cfg: &Config{KernelSrc: dir}}).readSyscallMap(nil)
+	assert.Error(t, err)
+}
+
+func TestSyscallTableIndirection(t *testing.T) {
+	dir := t.TempDir()
+	for file, data := range map[string]string{
+		"scripts/syscall.tbl": `
+0	common	io_setup	sys_io_setup
+1	32	fcntl64		sys_fcntl64
+2	64	fcntl		sys_fcntl
+3	renameat	renameat	sys_renameat
+4	time32	utime		sys_utime32
+`,
+		"arch/arm64/kernel/Makefile.syscalls": `
+syscall_abis_32 += time32
+syscall_abis_64 += renameat rlimit # memfd_secret
+`,
+		"arch/riscv/kernel/Makefile.syscalls": `
+syscall_abis_64 += riscv
+syscalltbl = $(srctree)/arch/riscv/tools/syscall_%.tbl
+`,
+		"arch/riscv/tools/syscall_64.tbl": `
+5	riscv	riscv_flush_icache	sys_riscv_flush_icache
+6	32	foo32			sys_foo32
+`,
+		"custom/extra.tbl": `
+7	common	extra	sys_extra
+`,
+	} {
+		if err := osutil.MkdirAll(filepath.Dir(filepath.Join(dir, file))); err != nil {
+			t.Fatal(err)
+		}
+		if err := osutil.WriteFile(filepath.Join(dir, file), []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := &context{cfg: &Config{KernelSrc: dir}}
+	syscalls, err := ctx.readSyscallDescs(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make(map[string][]string)
+	for syscall, descs := range syscalls {
+		for _, desc := range descs {
+			assert.True(t, desc.is64bit, "%v: %+v", syscall, desc)
+			names[syscall] = append(names[syscall], desc.syzArch)
+		}
+	}
+	assert.Equal(t, map[string][]string{
+		"io_setup":           {"arm64"},
+		"fcntl":              {"arm64"},
+		"renameat":           {"arm64"},
+		"riscv_flush_icache": {"riscv64"},
+	}, names)
+
+	ctx = &context{cfg: &Config{
+		KernelSrc:         dir,
+		SyscallTables:     []string{"custom/*.tbl", "arch/riscv/tools/*.tbl"},
+		OnlySyscallTables: true,
+	}}
+	syscalls, err = ctx.readSyscallDescs(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names = make(map[string][]string)
+	for syscall, descs := range syscalls {
+		for _, desc := range descs {
+			names[syscall] = append(names[syscall], desc.syzArch)
+		}
+	}
+	// The custom table is not attributed to any arch.
+	assert.Equal(t, map[string][]string{
+		"extra":              {""},
+		"riscv_flush_icache": {"riscv64"},
+	}, names)
+
+	ctx = &context{cfg: &Config{KernelSrc: dir, SyscallTables: []string{"nonexistent/*.tbl"}}}
+	_, err = ctx.readSyscallDescs(nil)
+	assert.ErrorContains(t, err, "matches no files")
+}
@@ -0,0 +1 @@
+// Source files are not used by the stub binary.
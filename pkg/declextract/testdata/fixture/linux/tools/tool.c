@@ -0,0 +1 @@
+// Excluded by the default exclude paths.
@@ -0,0 +1,4 @@
+#!/bin/sh
+# Stub of the syz-declextract binary for the fixture kernel:
+# prints the canned output for the file (invoked as "syz-declextract -p db file ...").
+cat "$3.out"
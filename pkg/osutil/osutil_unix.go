@@ -51,6 +51,23 @@ func ProcessTempDir(where string) (string, error) {
 	return "", fmt.Errorf("too many live instances")
 }
 
+// LockFile takes an exclusive lock on the file (created if it does not exist), blocking until
+// the lock is released by other processes. The lock is released by unlock or when the process exits.
+func LockFile(file string) (unlock func(), err error) {
+	lkf, err := syscall.Open(file, syscall.O_RDWR|syscall.O_CREAT, DefaultFilePerm)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(lkf, syscall.LOCK_EX); err != nil {
+		syscall.Close(lkf)
+		return nil, err
+	}
+	return func() {
+		syscall.Flock(lkf, syscall.LOCK_UN)
+		syscall.Close(lkf)
+	}, nil
+}
+
 func cleanupTempDir(path, pidfile string) bool {
 	data, err := os.ReadFile(pidfile)
 	if err == nil && len(data) > 0 {
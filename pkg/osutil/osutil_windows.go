@@ -47,5 +47,9 @@ func SandboxChown(file string) error {
 func setPdeathsig(cmd *exec.Cmd, hardKill bool) {
 }
 
+func LockFile(file string) (unlock func(), err error) {
+	return nil, fmt.Errorf("file locking is not supported")
+}
+
 func killPgroup(cmd *exec.Cmd) {
 }
@@ -4,543 +4,1253 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"io/fs"
-	"math/rand"
+	"log/slog"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"runtime"
+	"regexp"
+	"runtime/debug"
 	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/google/go-cmp/cmp"
 	"github.com/google/syzkaller/pkg/ast"
 	"github.com/google/syzkaller/pkg/compiler"
+	"github.com/google/syzkaller/pkg/declextract"
+	"github.com/google/syzkaller/pkg/hash"
 	"github.com/google/syzkaller/pkg/mgrconfig"
 	"github.com/google/syzkaller/pkg/osutil"
 	"github.com/google/syzkaller/pkg/subsystem"
-	_ "github.com/google/syzkaller/pkg/subsystem/lists"
 	"github.com/google/syzkaller/pkg/tool"
-	"github.com/google/syzkaller/sys/targets"
+	"github.com/google/syzkaller/prog"
 )
 
-var (
-	autoFile = filepath.FromSlash("sys/linux/auto.txt")
-	target   = targets.Get(targets.Linux, targets.AMD64)
-)
+var autoFile = filepath.FromSlash("sys/linux/auto.txt")
 
 func main() {
 	var (
-		flagConfig       = flag.String("config", "", "manager config file")
-		flagBinary       = flag.String("binary", "syz-declextract", "path to syz-declextract binary")
+		flagConfig  = flag.String("config", "", "manager config file")
+		flagBinary  = flag.String("binary", "syz-declextract", "path to syz-declextract binary")
+		flagRetries = flag.Int("retries", 0, "number of retries for syz-declextract binary invocations"+
+			" that failed due to transient reasons (e.g. killed by OOM)")
+		flagJobs = flag.Int("j", 0, "number of files extracted and syscall tables read in parallel"+
+			" (number of CPUs if 0)")
+		flagMemLimit = flag.Int("mem-limit", 0, "limit of memory (address space) of each binary process in MB"+
+			" (Linux only); files the binary runs out of memory on fail with a clear error instead of"+
+			" triggering the OOM killer")
 		flagCacheExtract = flag.Bool("cache-extract", false, "use cached extract results if present"+
 			" (cached in manager.workdir/declextract.cache)")
+		flagChangedFiles = flag.String("changed-files", "", "file with a list of changed source files"+
+			" (e.g. git diff --name-only output); only these files are re-extracted and merged"+
+			" into the existing descriptions")
+		flagAllowlistFiles = flag.String("allowlist-files", "", "file with a list of source files (relative to"+
+			" the kernel source dir) to extract; unlike -changed-files, the descriptions are generated only"+
+			" from these files (headers in the list are ignored, they are extracted with the files including them)")
+		flagProvenance = flag.Bool("provenance", false, "write source files of each generated node"+
+			" to "+autoFile+".provenance")
+		flagAnnotateCalls = flag.Bool("annotate-calls", false, "precede each call in "+autoFile+
+			" with a comment with subsystems and source files of the call")
+		flagListFiles         = flag.Bool("list-files", false, "print the list of files that would be processed and exit")
+		flagVerifyDeterminism = flag.Bool("verify-determinism", false, "run extraction twice with different"+
+			" order of files and fail if the results differ")
+		flagSkipSyscalls = flag.String("skip-syscalls", "", "file with a list of additional syscalls"+
+			" to exclude from the descriptions (one per line)")
+		flagTiming      = flag.Int("timing", 0, "print N slowest files and the total extraction time")
+		flagTimingFile  = flag.String("timing-file", "", "write extraction time for each file to this file")
+		flagReportEmpty = flag.String("report-empty", "", "write the list of files that produced"+
+			" no descriptions and interfaces to this file")
+		flagMetricsOut = flag.String("metrics-out", "", "write metrics of the run to this file"+
+			" (in Prometheus text format), failed and interrupted runs write them as well")
+		flagExtraArgs        multiFlag
+		flagExtraObj         multiFlag
+		flagClangResourceDir = flag.String("clang-resource-dir", "", "clang resource dir with the builtin"+
+			" headers (passed to clang as -resource-dir), for binaries that can't find the headers themselves")
+		flagSysroot          = flag.String("sysroot", "", "sysroot for clang (passed to clang as --sysroot)")
+		flagSuppressWarnings = flag.Bool("suppress-warnings", true, "pass -w to clang to suppress compiler warnings")
+		flagCompat           = flag.Bool("compat", false, "generate $compat variants of syscalls for compat syscall entries")
+		flagStrict           = flag.Bool("strict", false, "fail if any warnings are produced")
+		flagAccess           = flag.String("access", "", "comma-separated list of access levels of interfaces"+
+			" to write to the info file (e.g. user,ns_admin; unknown needs to be requested explicitly;"+
+			" levels are mapped with -access-map first)")
+		flagSortBy = flag.String("sort-by", "id", "order of interfaces in the info file"+
+			" (id, subsystem, file or family)")
+		flagSeed              = flag.Int64("seed", 0, "seed for the random order of files (0 means a random seed)")
+		flagNoShuffle         = flag.Bool("no-shuffle", false, "process files in the compilation database order")
+		flagLimit             = flag.Int("limit", 0, "process only the first N files (for smoke testing)")
+		flagPerSubsystemLimit = flag.Int("per-subsystem-limit", 0, "process at most N files of each subsystem"+
+			" (files are sampled in the shuffled order, so the sample is deterministic with -seed)")
+		flagRedundant = flag.String("redundant", "", "write interfaces that have both manual and auto"+
+			" descriptions to this file (manual descriptions for them may be redundant)")
+		flagMissingOnly = flag.String("missing-only", "", "write interfaces that have neither manual"+
+			" nor auto descriptions to this file (sorted by subsystem)")
+		flagWarnIncomplete = flag.Bool("warn-incomplete", false, "log interfaces with unspecified func, access"+
+			" or identifying const grouped by type (this does not fail the run in -strict mode)")
+		flagWarnIncludes = flag.Bool("warn-includes", false, "log a summary of includes that are outside"+
+			" of the kernel source and build dirs (they likely don't resolve from the descriptions)"+
+			" with the files they come from")
+		flagPrimarySubsystem = flag.Bool("primary-subsystem", false, "record the subsystem most of the files"+
+			" of each interface belong to as primary_subsystem in "+autoFile+".info")
+		flagNoSubsystems = flag.Bool("no-subsystems", false, "don't attribute interfaces to subsystems"+
+			" (the subsystem fields in "+autoFile+".info are empty), this speeds up focused runs")
+		flagRefreshSubsystems = flag.Bool("refresh-subsystems", false, "only recompute subsystems of interfaces"+
+			" in the existing "+autoFile+".info with the current subsystem list (see -subsystems-file"+
+			" and -primary-subsystem) without extracting the kernel, and exit")
+		flagOnlyNew = flag.String("only-new", "", "write interfaces that are not present in the existing "+
+			autoFile+".info to this file ('-' prints them to stdout)")
+		flagLogLevel = flag.String("log-level", "info", "minimal level of logged messages"+
+			" (debug, info, warn, error)")
+		flagLogFormat       = flag.String("log-format", "text", "format of logged messages (text or json)")
+		flagExcludePaths    multiFlag
+		flagCompileCommands = flag.String("compile-commands", "", "compilation database to use instead of"+
+			" compile_commands.json in kernel_obj; '-' reads the commands to extract from stdin (e.g. pre-filtered"+
+			" by another tool), they must be a subset of the kernel_obj database the binary gets the flags from")
+		flagSourcePrefix = flag.String("source-prefix", "", "process only files in this dir"+
+			" (absolute or relative to the kernel source dir), e.g. if the compilation database"+
+			" covers more than the kernel; applied in addition to the other filters")
+		flagSplitBySubsystem = flag.String("split-by-subsystem", "", "additionally write parts of the"+
+			" descriptions related to each subsystem to auto_<subsystem>.txt files in this dir"+
+			" (outside of sys/linux, the parts duplicate the combined descriptions)")
+		flagModuleSrc = flag.String("module-src", "", "source dir of an out-of-tree kernel module to extract"+
+			" (module files and includes are relative to it, kernel headers are relative to the kernel dirs)")
+		flagAccessMap = flag.String("access-map", "", "file with mapping of access levels of interfaces to"+
+			" canonical ones written to the info file (one 'access canonical' pair per line, levels that are"+
+			" not in the map are kept as is and reported as warnings, see -strict)")
+		flagSyscallTables = flag.String("syscall-tables", "", "comma-separated list of globs of syscall table"+
+			" files (relative to the kernel source dir) to read in addition to the tables found in the arch dirs")
+		flagOnlySyscallTables = flag.Bool("only-syscall-tables", false, "read only -syscall-tables"+
+			" and don't look for syscall tables in the arch dirs")
+		flagRenameFile = flag.String("rename-file", "", "file with additional mapping of functions"+
+			" to emitted call names (one 'function call' pair per line)")
+		flagHeaderIncludes = flag.String("header-includes", strings.Join(declextract.DefaultHeaderIncludes, ","),
+			"comma-separated list of headers included at the top of "+autoFile+" before all other includes")
+		flagValidate = flag.Bool("validate", false, "check that all calls in the generated descriptions"+
+			" have syscall table entries (problems are reported as warnings, see -strict)")
+		flagCheckSyscallNumbers = flag.Bool("check-syscall-numbers", false, "check that __NR_ consts"+
+			" of extracted syscalls in the existing .const files match syscall numbers in the syscall tables"+
+			" (mismatches are reported as warnings, see -strict)")
+		flagExcludeNodeTypes = flag.String("exclude-node-types", "", "comma-separated list of node types"+
+			" to drop from the descriptions, e.g. intflags if the flags are described manually"+
+			" ("+strings.Join(declextract.NodeTypes, ", ")+")")
+		flagMergeStructs = flag.Bool("merge-structs", false, "merge structs with the same name"+
+			" that differ only in the order of fields")
+		flagCanonical = flag.Bool("canonical", false, "normalize the descriptions further (e.g. sort values"+
+			" of flags), so that semantically equal extractions are byte-identical")
+		flagCacheOnly = flag.Bool("cache-only", false, "use only cached extract results"+
+			" (see -cache-extract) and never run the binary")
+		flagDumpRename = flag.Bool("dump-rename", false, "print mapping of functions to syscall names"+
+			" (with the syscall table entries that were preferred) and exit")
+		flagGit = flag.Bool("git", false, "print git diff --stat and git status of the written files"+
+			" (skipped if they are not in a git repo)")
+		flagCompileCheck = flag.String("compile-check", "", "comma-separated list of arches to compile"+
+			" all descriptions for after "+autoFile+" is written ('all' for all arches), errors fail the run;"+
+			" run syz-extract before to generate consts of new descriptions, missing consts are warnings")
+		flagReportAmbiguous = flag.String("report-ambiguous", "", "write syscalls that have table entries"+
+			" with different functions (with the preferred and the other functions) to this file"+
+			" ('-' prints them to stdout); fails in -strict mode if there are any")
+		flagSkipKnownFailing = flag.Bool("skip-known-failing", false, "skip files that failed in the previous"+
+			" runs and did not succeed since then")
+		flagRetryFailing = flag.Bool("retry-failing", false, "process files that failed in the previous runs"+
+			" even if -skip-known-failing is set")
+		flagResume = flag.Bool("resume", false, "resume an interrupted run: extract only files"+
+			" that don't have cached outputs (same as -cache-extract)")
+		flagOutput = flag.String("output", autoFile, "file to write the descriptions to"+
+			" (the info file is written next to it); '-' writes only the descriptions to stdout")
+		flagDumpRaw = flag.String("dump-raw", "", "write the nodes as they were extracted from each file"+
+			" to this file (and the interfaces to the file with .info suffix) before the descriptions"+
+			" are sorted, deduplicated and merged, for debugging of the assembly of the descriptions")
+		flagStats = flag.Bool("stats", false, "log numbers of distinct calls, structs (and near-duplicate"+
+			" struct names that differ only in a numeric suffix), resources and typedefs in the descriptions"+
+			" along with the numbers for the existing "+autoFile+" (sudden growth means a type explosion)")
+		flagMaxShrinkPercent = flag.Int("max-shrink-percent", 0, "fail before writing the descriptions if the number"+
+			" of nodes in the descriptions dropped by more than N percent compared to the existing "+autoFile+
+			" (e.g. due to a broken binary)")
+		flagMinClang = flag.String("min-clang", "", "minimum clang version (e.g. 18.1) the binary needs"+
+			" to be built with, older versions are reported as warnings (fail in -strict mode)")
+		flagVersion      = flag.Bool("version", false, "print versions of the tool and the binary, and exit")
+		flagCheckVersion = flag.Bool("check-version", false, "only check that "+autoFile+" was generated"+
+			" with the same versions of the binary and syzkaller, and exit (fails in -strict mode)")
+		flagConcurrencySafe = flag.Bool("concurrency-safe-temp", false, "wait for other runs in the same tree"+
+			" to finish (a lock in the temp dir is held from reading the existing descriptions to writing"+
+			" the new ones), so that concurrent runs don't corrupt each other's results")
+		flagTestFixture = flag.String("test-fixture", "", "run extraction on the fixture kernel in the dir"+
+			" and check that the results match its golden files, and exit (see declextract.CheckFixture)")
+		flagSubsystemsFile = flag.String("subsystems-file", "", "JSON file with the list of subsystems"+
+			" to use instead of the built-in list (see declextract.LoadSubsystems for the format)")
+		flagDiff = flag.Bool("diff", false, "print changes in the descriptions"+
+			" compared to the existing "+autoFile)
+		flagInfoOnly = flag.Bool("info-only", false, "write only "+autoFile+".info"+
+			" (presence of auto descriptions is checked against the existing "+autoFile+")")
+		flagDefaultExcludePaths = flag.Bool("default-exclude-paths", true, "exclude files in "+
+			strings.Join(declextract.DefaultExcludePaths, ", ")+" dirs")
 	)
-	defer tool.Init()()
+	flag.Var(&flagExtraArgs, "extra-arg", "additional argument to append to the clang command line"+
+		" (can be specified multiple times)")
+	flag.Var(&flagExtraObj, "extra-obj", "build dir of the same kernel sources with a different config;"+
+		" its files are extracted in addition to the manager config kernel_obj files, and the results are merged"+
+		" (can be specified multiple times)")
+	flag.Var(&flagExcludePaths, "exclude-path", "glob pattern for source files or dirs (relative to the kernel"+
+		" source dir) to exclude from extraction (can be specified multiple times)")
+	// Profiles are written by exit as well, so that failed runs can be profiled too.
+	stopProfiling = tool.Init()
+	defer stopProfiling()
+	var err error
+	logger, err = newLogger(*flagLogLevel, *flagLogFormat)
+	if err != nil {
+		tool.Fail(err)
+	}
+	slog.SetDefault(logger)
+	// Metrics are written by exit as well, so that failed runs are accounted for.
+	runMetrics.file, runMetrics.start = *flagMetricsOut, time.Now()
+	defer writeMetrics(0)
+	if *flagVersion {
+		printVersion(*flagBinary)
+		return
+	}
+	if *flagCheckVersion {
+		checkVersion(*flagBinary, *flagStrict)
+		return
+	}
+	if *flagTestFixture != "" {
+		if err := declextract.CheckFixture(*flagTestFixture, false); err != nil {
+			failf("finish", "%v", err)
+		}
+		logger.Info("fixture results match golden files", "phase", "finish")
+		return
+	}
+	if *flagMinClang != "" {
+		checkClangVersion(*flagBinary, *flagMinClang, *flagStrict)
+	}
+	if err := declextract.SortInterfaces(nil, *flagSortBy); err != nil {
+		failf("load", "%v", err)
+	}
+	if *flagNoSubsystems && (*flagSubsystemsFile != "" || *flagPrimarySubsystem || *flagRefreshSubsystems ||
+		*flagSplitBySubsystem != "" || *flagPerSubsystemLimit != 0) {
+		failf("load", "-no-subsystems can't be combined with other subsystem flags")
+	}
+	var subsystems []*subsystem.Subsystem
+	if *flagSubsystemsFile != "" {
+		subsystems, err = declextract.LoadSubsystems(*flagSubsystemsFile)
+		if err != nil {
+			failf("load", "failed to load subsystems: %v", err)
+		}
+	}
+	if *flagRefreshSubsystems {
+		refreshSubsystems(subsystems, *flagPrimarySubsystem, *flagSortBy, *flagStrict)
+		return
+	}
 	cfg, err := mgrconfig.LoadFile(*flagConfig)
 	if err != nil {
-		tool.Failf("failed to load manager config: %v", err)
+		failf("load", "failed to load manager config: %v", err)
+	}
+	// The manager config resolves relative kernel dirs against the current dir, but does not check them.
+	// The dirs from flags are resolved the same way, so that relative paths work from any dir.
+	checkDir("kernel_src", cfg.KernelSrc)
+	checkDir("kernel_obj", cfg.KernelObj)
+	for i, obj := range flagExtraObj {
+		flagExtraObj[i] = osutil.Abs(obj)
+		checkDir("-extra-obj", flagExtraObj[i])
+	}
+	if *flagModuleSrc != "" {
+		*flagModuleSrc = osutil.Abs(*flagModuleSrc)
+		checkDir("-module-src", *flagModuleSrc)
+	}
+
+	var skipSyscalls map[string]bool
+	if *flagSkipSyscalls != "" {
+		data, err := os.ReadFile(*flagSkipSyscalls)
+		if err != nil {
+			failf("load", "failed to read skip syscalls file: %v", err)
+		}
+		skipSyscalls = declextract.ParseSyscallList(data)
+	}
+	var renames map[string][]string
+	if *flagRenameFile != "" {
+		data, err := os.ReadFile(*flagRenameFile)
+		if err != nil {
+			failf("load", "failed to read rename file: %v", err)
+		}
+		if renames, err = declextract.ParseRenameList(data); err != nil {
+			failf("load", "bad rename file %v: %v", *flagRenameFile, err)
+		}
+	}
+	var accessMap map[string]string
+	if *flagAccessMap != "" {
+		data, err := os.ReadFile(*flagAccessMap)
+		if err != nil {
+			failf("load", "failed to read access map: %v", err)
+		}
+		if accessMap, err = declextract.ParseAccessMap(data); err != nil {
+			failf("load", "bad access map %v: %v", *flagAccessMap, err)
+		}
+	}
+	var syscallTables []string
+	for _, glob := range strings.Split(*flagSyscallTables, ",") {
+		if glob = strings.TrimSpace(glob); glob != "" {
+			syscallTables = append(syscallTables, glob)
+		}
+	}
+	if *flagOnlySyscallTables && len(syscallTables) == 0 {
+		failf("load", "-only-syscall-tables requires -syscall-tables")
+	}
+	if *flagDumpRename {
+		data, err := declextract.DumpSyscallMap(&declextract.Config{
+			KernelSrc:         cfg.KernelSrc,
+			SyscallTables:     syscallTables,
+			OnlySyscallTables: *flagOnlySyscallTables,
+			SkipSyscalls:      skipSyscalls,
+			RenameSyscalls:    renames,
+		})
+		if err != nil {
+			failf("load", "%v", err)
+		}
+		os.Stdout.Write(data)
+		return
+	}
+	if *flagReportAmbiguous != "" {
+		reportAmbiguous(*flagReportAmbiguous, &declextract.Config{
+			KernelSrc:         cfg.KernelSrc,
+			SyscallTables:     syscallTables,
+			OnlySyscallTables: *flagOnlySyscallTables,
+			SkipSyscalls:      skipSyscalls,
+		}, *flagStrict)
 	}
 
 	compilationDatabase := filepath.Join(cfg.KernelObj, "compile_commands.json")
-	cmds, err := loadCompileCommands(compilationDatabase)
+	if *flagModuleSrc != "" {
+		// Out-of-tree module builds generate the compilation database in the module dir.
+		compilationDatabase = filepath.Join(*flagModuleSrc, "compile_commands.json")
+	}
+	var exclude []string
+	if *flagDefaultExcludePaths {
+		exclude = append(exclude, declextract.DefaultExcludePaths...)
+	}
+	exclude = append(exclude, flagExcludePaths...)
+	commandsFile := compilationDatabase
+	if *flagCompileCommands != "" {
+		commandsFile = *flagCompileCommands
+		if commandsFile != "-" {
+			commandsFile = osutil.Abs(commandsFile)
+			compilationDatabase = commandsFile
+		}
+	}
+	cmds, err := declextract.LoadCompileCommands(commandsFile, cfg.KernelSrc, exclude, *flagSourcePrefix, logger)
 	if err != nil {
-		tool.Failf("failed to load compile commands: %v", err)
+		failf("load", "failed to load compile commands: %v", err)
+	}
+	for _, obj := range flagExtraObj {
+		// Commands for other builds are extracted with their own databases and merged.
+		extraCmds, err := declextract.LoadCompileCommands(filepath.Join(obj, "compile_commands.json"),
+			cfg.KernelSrc, exclude, *flagSourcePrefix, logger)
+		if err != nil {
+			failf("load", "failed to load compile commands: %v", err)
+		}
+		cmds = append(cmds, extraCmds...)
+	}
+	if *flagAllowlistFiles != "" {
+		allowed, err := readFileList(*flagAllowlistFiles, cfg.KernelSrc)
+		if err != nil {
+			failf("load", "failed to read allowlisted files: %v", err)
+		}
+		matched := make(map[string]bool)
+		cmds = slices.DeleteFunc(cmds, func(cmd declextract.CompileCommand) bool {
+			file := filepath.Clean(cmd.File)
+			matched[file] = true
+			return !allowed[file]
+		})
+		for file := range allowed {
+			if !matched[file] && !strings.HasSuffix(file, ".h") {
+				logger.Warn("allowlisted file has no compile command", "phase", "load", "file", file)
+			}
+		}
+	}
+	var prev *ast.Description
+	var prevProvenance map[string][]string
+	if *flagCompileCheck != "" && (*flagOutput != autoFile || *flagInfoOnly) {
+		failf("load", "-compile-check can be used only when %v is written", autoFile)
+	}
+	if *flagOutput == "-" && (*flagInfoOnly || *flagDiff) {
+		failf("load", "-output=- can't be used with -info-only and -diff")
+	}
+	if *flagInfoOnly && *flagChangedFiles != "" {
+		failf("load", "-info-only can't be used with -changed-files (the info file is not written in this mode)")
+	}
+	if *flagChangedFiles != "" {
+		changed, err := readFileList(*flagChangedFiles, cfg.KernelSrc)
+		if err != nil {
+			failf("load", "failed to read changed files: %v", err)
+		}
+		cmds = slices.DeleteFunc(cmds, func(cmd declextract.CompileCommand) bool {
+			return !changed[filepath.Clean(cmd.File)]
+		})
+		// The previous descriptions are merged into the new ones, so the lock is held from here.
+		if *flagConcurrencySafe {
+			lockTree()
+		}
+		prev = ast.ParseGlob(autoFile, errorHandler("load"))
+		if prev == nil {
+			failf("load", "failed to parse existing %v", autoFile)
+		}
+		if data, err := os.ReadFile(autoFile + ".provenance"); err == nil {
+			if prevProvenance, err = declextract.ParseProvenance(data); err != nil {
+				failf("load", "failed to parse %v.provenance: %v", autoFile, err)
+			}
+			// The provenance of the merged descriptions is needed for the next incremental run.
+			*flagProvenance = true
+		} else {
+			logger.Warn(fmt.Sprintf("%v.provenance is missing, nodes with the same names as the extracted"+
+				" nodes are replaced even if they come from unchanged files (run once with -provenance"+
+				" to merge only nodes of the changed files)", autoFile), "phase", "load")
+		}
+	}
+	cacheDir := filepath.Join(cfg.Workdir, "declextract.cache")
+	runMetrics.cacheDir = cacheDir
+	failing, err := declextract.LoadFailingFiles(cacheDir)
+	if err != nil {
+		failf("load", "failed to load failing files: %v", err)
+	}
+	if len(failing) != 0 {
+		var files []string
+		for _, f := range failing {
+			files = append(files, f.String())
+		}
+		logger.Warn(fmt.Sprintf("%v files failed in the previous runs: %v", len(failing),
+			strings.Join(files, ", ")), "phase", "load")
+	}
+	if *flagSkipKnownFailing && !*flagRetryFailing && len(failing) != 0 {
+		// Files are skipped only in the builds they failed in.
+		cmds = slices.DeleteFunc(cmds, func(cmd declextract.CompileCommand) bool {
+			return slices.Contains(failing, declextract.FailingFile{Database: cmd.Database, File: cmd.File})
+		})
+	}
+	if !*flagNoShuffle {
+		// Shuffle the order to detect any non-determinism caused by the order early.
+		// The result should be the same regardless.
+		seed := *flagSeed
+		if seed == 0 {
+			seed = time.Now().UnixNano()
+		}
+		logger.Debug(fmt.Sprintf("shuffling files with seed %v", seed), "phase", "load")
+		declextract.ShuffleCompileCommands(cmds, seed)
+	}
+	if *flagPerSubsystemLimit != 0 {
+		total := len(cmds)
+		var warnings int
+		limitCfg := &declextract.Config{
+			KernelSrc:      cfg.KernelSrc,
+			KernelObj:      cfg.KernelObj,
+			ExtraKernelObj: flagExtraObj,
+			ModuleSrc:      *flagModuleSrc,
+			Subsystems:     subsystems,
+			Logger:         logger,
+		}
+		cmds, warnings = declextract.LimitPerSubsystem(limitCfg, cmds, *flagPerSubsystemLimit)
+		if *flagStrict && warnings != 0 {
+			failf("load", "got %v warnings in strict mode", warnings)
+		}
+		logger.Warn(fmt.Sprintf("processing only %v out of %v files (at most %v per subsystem),"+
+			" removal of unused descriptions may be inaccurate", len(cmds), total, *flagPerSubsystemLimit),
+			"phase", "load")
+	}
+	if *flagLimit != 0 && *flagLimit < len(cmds) {
+		logger.Warn(fmt.Sprintf("processing only %v out of %v files, removal of unused descriptions"+
+			" may be inaccurate", *flagLimit, len(cmds)), "phase", "load")
+		cmds = cmds[:*flagLimit]
+	}
+	if *flagListFiles {
+		listFiles(cmds, cfg)
+		return
+	}
+	if *flagMemLimit < 0 {
+		failf("load", "bad -mem-limit %v", *flagMemLimit)
+	}
+	var clangArgs []string
+	if *flagSuppressWarnings {
+		// Suppress warning since we may build the tool on a different clang
+		// version that produces more warnings.
+		clangArgs = append(clangArgs, "-w")
+	}
+	if *flagClangResourceDir != "" {
+		*flagClangResourceDir = osutil.Abs(*flagClangResourceDir)
+		checkDir("-clang-resource-dir", *flagClangResourceDir)
+		clangArgs = append(clangArgs, "-resource-dir="+*flagClangResourceDir)
+	}
+	if *flagSysroot != "" {
+		*flagSysroot = osutil.Abs(*flagSysroot)
+		checkDir("-sysroot", *flagSysroot)
+		clangArgs = append(clangArgs, "--sysroot="+*flagSysroot)
+	}
+	// Extra args go last, so that they can override the args above.
+	clangArgs = append(clangArgs, flagExtraArgs...)
+	headerIncludes := []string{}
+	for _, inc := range strings.Split(*flagHeaderIncludes, ",") {
+		if inc = strings.TrimSpace(inc); inc != "" {
+			headerIncludes = append(headerIncludes, inc)
+		}
+	}
+	var excludeNodeTypes []string
+	for _, typ := range strings.Split(*flagExcludeNodeTypes, ",") {
+		if typ = strings.TrimSpace(typ); typ != "" {
+			excludeNodeTypes = append(excludeNodeTypes, typ)
+		}
+	}
+	var access map[string]bool
+	if *flagAccess != "" {
+		access = make(map[string]bool)
+		for _, level := range strings.Split(*flagAccess, ",") {
+			access[strings.TrimSpace(level)] = true
+		}
 	}
 
-	ctx := &context{
-		cfg:                 cfg,
-		clangTool:           *flagBinary,
-		compilationDatabase: compilationDatabase,
-		compileCommands:     cmds,
-		extractor:           subsystem.MakeExtractor(subsystem.GetList(target.OS)),
-		syscallNameMap:      readSyscallMap(cfg.KernelSrc),
-		interfaces:          make(map[string]Interface),
+	var syscallConsts *compiler.ConstFile
+	if *flagCheckSyscallNumbers {
+		syscallConsts = compiler.DeserializeConstFile(filepath.Join(filepath.Dir(autoFile), "*.const"),
+			errorHandler("load"))
+		if syscallConsts == nil {
+			failf("load", "failed to load const files")
+		}
+	}
+	// On SIGINT files being extracted are still cached, so the run can be continued with -resume.
+	// A second SIGINT aborts the run and kills the binaries running on in-flight files.
+	shutdown := make(chan struct{})
+	osutil.HandleInterrupts(shutdown)
+	abortCtx, abort := context.WithCancel(context.Background())
+	defer abort()
+	interrupts := make(chan os.Signal, 2)
+	signal.Notify(interrupts, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-interrupts
+		<-interrupts
+		logger.Warn("aborting, in-flight files are not cached", "phase", "extract")
+		abort()
+	}()
+	extractCfg := &declextract.Config{
+		Binary:              *flagBinary,
+		KernelSrc:           cfg.KernelSrc,
+		KernelObj:           cfg.KernelObj,
+		CompilationDatabase: compilationDatabase,
+		ModuleSrc:           *flagModuleSrc,
+		ExtraKernelObj:      flagExtraObj,
+		CompileCommands:     cmds,
+		CacheDir:            cacheDir,
+		UseCache:            *flagCacheExtract || *flagResume,
+		CacheOnly:           *flagCacheOnly,
+		Retries:             *flagRetries,
+		Concurrency:         *flagJobs,
+		MemLimit:            uint64(*flagMemLimit) << 20,
+		ClangArgs:           clangArgs,
+		SkipSyscalls:        skipSyscalls,
+		SyscallTables:       syscallTables,
+		OnlySyscallTables:   *flagOnlySyscallTables,
+		RenameSyscalls:      renames,
+		Compat:              *flagCompat,
+		AutoFile:            autoFile,
+		PrevDescriptions:    prev,
+		PrevProvenance:      prevProvenance,
+		Provenance:          *flagProvenance,
+		AnnotateCalls:       *flagAnnotateCalls,
+		InfoOnly:            *flagInfoOnly,
+		MergeStructs:        *flagMergeStructs,
+		Canonical:           *flagCanonical,
+		HeaderIncludes:      headerIncludes,
+		ExcludeNodeTypes:    excludeNodeTypes,
+		RawFile:             *flagDumpRaw,
+		Validate:            *flagValidate,
+		SyscallConsts:       syscallConsts,
+		Subsystems:          subsystems,
+		PrimarySubsystems:   *flagPrimarySubsystem,
+		NoSubsystems:        *flagNoSubsystems,
+		AccessMap:           accessMap,
+		WarnIncomplete:      *flagWarnIncomplete,
+		WarnIncludes:        *flagWarnIncludes,
+		Logger:              logger,
+		Shutdown:            shutdown,
+		Context:             abortCtx,
+	}
+	if *flagConcurrencySafe {
+		extractCfg.BeforeFinish = lockTree
+	}
+	if *flagSplitBySubsystem != "" {
+		// Includes are split by the files they come from.
+		extractCfg.Provenance = true
+	}
+	res, descData, ifacesData := extract(extractCfg, access, *flagSortBy)
+	runMetrics.res = res
+	if *flagStrict && res.Warnings != 0 {
+		failf("finish", "got %v warnings in strict mode", res.Warnings)
+	}
+	if *flagStats && res.Descriptions != nil {
+		printStats(res.Descriptions)
+	}
+	if *flagMaxShrinkPercent != 0 && res.Descriptions != nil {
+		checkShrink(res.Descriptions, *flagMaxShrinkPercent)
+	}
+	if *flagTiming != 0 {
+		printTimings(res.Timings, *flagTiming)
+	}
+	if *flagTimingFile != "" {
+		if err := osutil.WriteFile(*flagTimingFile, serializeTimings(res.Timings)); err != nil {
+			failf("finish", "%v", err)
+		}
+	}
+	if *flagReportEmpty != "" {
+		w := new(bytes.Buffer)
+		for _, file := range res.EmptyFiles {
+			fmt.Fprintf(w, "%v\n", file)
+		}
+		if err := osutil.WriteFile(*flagReportEmpty, w.Bytes()); err != nil {
+			failf("finish", "%v", err)
+		}
+	}
+	if *flagRedundant != "" {
+		redundant := slices.DeleteFunc(slices.Clone(res.Interfaces), func(iface declextract.Interface) bool {
+			return !iface.ManualDescriptions || !iface.AutoDescriptions
+		})
+		if err := osutil.WriteFile(*flagRedundant, declextract.SerializeInterfaces(redundant)); err != nil {
+			failf("finish", "%v", err)
+		}
+	}
+	if *flagMissingOnly != "" {
+		missing := slices.DeleteFunc(slices.Clone(res.Interfaces), func(iface declextract.Interface) bool {
+			return iface.ManualDescriptions || iface.AutoDescriptions
+		})
+		if err := declextract.SortInterfaces(missing, "subsystem"); err != nil {
+			failf("finish", "%v", err)
+		}
+		if err := osutil.WriteFile(*flagMissingOnly, declextract.SerializeInterfaces(missing)); err != nil {
+			failf("finish", "%v", err)
+		}
+	}
+	if *flagOnlyNew != "" {
+		writeNewInterfaces(*flagOnlyNew, res.Interfaces)
+	}
+	if *flagVerifyDeterminism {
+		// Run extraction again with a different order of files, the result should be the same.
+		cfg1 := *extractCfg
+		cfg1.CompileCommands = slices.Clone(cmds)
+		declextract.ShuffleCompileCommands(cfg1.CompileCommands, time.Now().UnixNano())
+		_, descData1, ifacesData1 := extract(&cfg1, access, *flagSortBy)
+		if diff := cmp.Diff(string(descData), string(descData1)); diff != "" {
+			failf("finish", "descriptions are not deterministic:\n%s", diff)
+		}
+		if diff := cmp.Diff(string(ifacesData), string(ifacesData1)); diff != "" {
+			failf("finish", "interfaces are not deterministic:\n%s", diff)
+		}
+	}
+	if *flagDiff && res.Descriptions != nil {
+		os.Stdout.Write(declextract.DiffDescriptions(readExisting(autoFile), res.Descriptions))
+	}
+	if *flagOutput == "-" {
+		// Pruning of unused descriptions is done in memory, so the output is the same as in the file.
+		// The info and provenance files are not written since there is no file they would accompany.
+		os.Stdout.Write(descData)
+		unlockTree()
+		return
+	}
+	if res.Descriptions != nil {
+		if err := writeIfChanged(*flagOutput, descData); err != nil {
+			failf("finish", "%v", err)
+		}
+	}
+	if *flagCompileCheck != "" {
+		var arches []string
+		if *flagCompileCheck != "all" {
+			arches = strings.Split(*flagCompileCheck, ",")
+		}
+		if err := declextract.CompileCheck(filepath.Dir(autoFile), arches, logger); err != nil {
+			failf("finish", "%v", err)
+		}
+	}
+	if *flagSplitBySubsystem != "" && res.Descriptions != nil {
+		writeSubsystemParts(*flagSplitBySubsystem, extractCfg, res)
+	}
+	if *flagProvenance && res.Descriptions != nil {
+		provenance := declextract.SerializeProvenance(res.Descriptions, res.Provenance)
+		if err := writeIfChanged(*flagOutput+".provenance", provenance); err != nil {
+			failf("finish", "%v", err)
+		}
 	}
 
-	outputs := make(chan *output, len(cmds))
-	files := make(chan string, len(cmds))
-	for w := 0; w < runtime.NumCPU(); w++ {
-		go ctx.worker(outputs, files, *flagCacheExtract)
+	// Interfaces extracted from a subset of files are incomplete,
+	// so don't overwrite the info file in incremental mode.
+	if *flagChangedFiles == "" {
+		if err := writeIfChanged(*flagOutput+".info", ifacesData); err != nil {
+			failf("finish", "%v", err)
+		}
 	}
+	unlockTree()
+	if *flagGit {
+		files := []string{*flagOutput, *flagOutput + ".info"}
+		if *flagProvenance {
+			files = append(files, *flagOutput+".provenance")
+		}
+		if *flagSplitBySubsystem != "" {
+			files = append(files, *flagSplitBySubsystem)
+		}
+		printGitStatus(files)
+	}
+}
 
-	for _, cmd := range cmds {
-		files <- cmd.File
+// printGitStatus prints a summary of changes in the files according to git,
+// nothing is printed if the files are not in a git repo (or git is not installed).
+func printGitStatus(files []string) {
+	dir := filepath.Dir(files[0])
+	if _, err := osutil.RunCmd(time.Minute, dir, "git", "rev-parse", "--is-inside-work-tree"); err != nil {
+		logger.Info("output is not in a git repo, skipping git status", "phase", "finish")
+		return
+	}
+	for i, file := range files {
+		files[i] = osutil.Abs(file)
+	}
+	for _, args := range [][]string{
+		{"diff", "--stat"},
+		// Shows new untracked files that are not present in the diff.
+		{"status", "--short"},
+	} {
+		out, err := osutil.RunCmd(time.Minute, dir, "git", append(append(args, "--"), files...)...)
+		if err != nil {
+			logger.Warn(fmt.Sprintf("git %v failed: %v", args[0], err), "phase", "finish")
+			return
+		}
+		os.Stdout.Write(out)
 	}
-	close(files)
+}
 
-	for range cmds {
-		out := <-outputs
-		if out == nil {
-			continue
+// extract runs the extraction and returns the result along with serialized descriptions and interfaces.
+// If access is set, only interfaces with these access levels are serialized.
+func extract(cfg *declextract.Config, access map[string]bool, sortBy string) (
+	*declextract.Result, []byte, []byte) {
+	res, err := declextract.Extract(cfg)
+	if errors.Is(err, declextract.ErrInterrupted) {
+		failf("extract", "interrupted, restart with -resume to continue")
+	}
+	var toolErr *declextract.ToolError
+	if errors.As(err, &toolErr) {
+		runMetrics.toolErrors++
+		failf("extract", "%v %v on %v (exit code %v):\n%v",
+			cfg.Binary, toolErr.Kind, toolErr.File, toolErr.ExitCode, toolErr)
+	}
+	if err != nil {
+		failf("extract", "%v", err)
+	}
+	interfaces := res.Interfaces
+	if access != nil {
+		interfaces = slices.DeleteFunc(slices.Clone(interfaces), func(iface declextract.Interface) bool {
+			return !access[iface.Access]
+		})
+	}
+	if sortBy != "id" {
+		interfaces = slices.Clone(interfaces)
+		if err := declextract.SortInterfaces(interfaces, sortBy); err != nil {
+			failf("finish", "%v", err)
 		}
-		file, err := filepath.Rel(cfg.KernelSrc, out.file)
+	}
+	var descData []byte
+	if res.Descriptions != nil {
+		descData, err = declextract.FormatDescriptions(res.Descriptions)
 		if err != nil {
-			tool.Fail(err)
+			failf("finish", "%v", err)
 		}
-		if out.err != nil {
-			tool.Failf("%v: %v", file, out.err)
-		}
-		parse := ast.Parse(out.output, "", nil)
-		if parse == nil {
-			tool.Failf("%v: parsing error:\n%s", file, out.output)
+	}
+	return res, descData, declextract.SerializeInterfaces(interfaces)
+}
+
+func printVersion(binary string) {
+	fmt.Printf("syzkaller revision: %v\n", prog.GitRevision)
+	if info, ok := debug.ReadBuildInfo(); ok {
+		fmt.Printf("tool: %v %v, built with %v\n", info.Main.Path, info.Main.Version, info.GoVersion)
+		for _, setting := range info.Settings {
+			if strings.HasPrefix(setting.Key, "vcs.") {
+				fmt.Printf("tool %v: %v\n", setting.Key, setting.Value)
+			}
 		}
-		ctx.appendNodes(parse.Nodes, file)
 	}
-	ctx.finishDescriptions()
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		fmt.Printf("binary: %v\n", err)
+		return
+	}
+	version, err := declextract.Version(path)
+	if err != nil {
+		failf("load", "failed to get version of %v: %v", path, err)
+	}
+	fmt.Printf("binary: %v (%v)\n", path, version)
+	out, err := osutil.Command(path, "--version").CombinedOutput()
+	if err != nil {
+		failf("load", "failed to run %v --version: %v\n%s", path, err, out)
+	}
+	os.Stdout.Write(out)
+}
 
-	desc := &ast.Description{
-		Nodes: ctx.nodes,
+var clangVersionRe = regexp.MustCompile(`(?:clang|LLVM) version ([0-9]+(?:\.[0-9]+)*)`)
+
+// checkClangVersion checks the clang version reported by the binary (or clang in PATH
+// if the binary does not report it). If neither of them is available, the check is skipped.
+func checkClangVersion(binary, minVersion string, strict bool) {
+	want, ok := parseClangVersion(minVersion)
+	if !ok {
+		failf("load", "bad -min-clang version %q", minVersion)
+	}
+	version := ""
+	for _, bin := range []string{binary, "clang"} {
+		path, err := exec.LookPath(bin)
+		if err != nil {
+			continue
+		}
+		out, _ := osutil.Command(path, "--version").CombinedOutput()
+		if match := clangVersionRe.FindSubmatch(out); match != nil {
+			version = string(match[1])
+			break
+		}
+	}
+	if version == "" {
+		logger.Info("can't determine clang version, skipping the check", "phase", "load")
+		return
 	}
-	writeDescriptions(desc)
-	// In order to remove unused bits of the descriptions, we need to write them out first,
-	// and then parse all descriptions back b/c auto descriptions use some types defined
-	// by manual descriptions (compiler.CollectUnused requires complete descriptions).
-	removeUnused(desc)
-	writeDescriptions(desc)
+	have, _ := parseClangVersion(version)
+	if slices.Compare(have, want) >= 0 {
+		return
+	}
+	logger.Warn(fmt.Sprintf("clang version %v is older than the required %v,"+
+		" extracted descriptions may differ", version, minVersion), "phase", "load")
+	if strict {
+		exit(1)
+	}
+}
 
-	ifaces := ctx.finishInterfaces()
-	ifacesData := serializeInterfaces(ifaces)
-	if err := osutil.WriteFile(autoFile+".info", ifacesData); err != nil {
-		tool.Fail(err)
+// parseClangVersion parses versions like 18.1.3 into a list of numbers.
+func parseClangVersion(version string) ([]int, bool) {
+	var res []int
+	for _, part := range strings.Split(version, ".") {
+		v, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, false
+		}
+		res = append(res, v)
 	}
+	return res, true
 }
 
-type context struct {
-	cfg                 *mgrconfig.Config
-	clangTool           string
-	compilationDatabase string
-	compileCommands     []compileCommand
-	extractor           *subsystem.Extractor
-	syscallNameMap      map[string][]string
-	interfaces          map[string]Interface
-	nodes               []ast.Node
+func checkVersion(binary string, strict bool) {
+	version, err := declextract.Version(binary)
+	if err != nil {
+		failf("load", "failed to get version of %v: %v", binary, err)
+	}
+	existing := readExisting(autoFile)
+	if existing == nil {
+		failf("load", "%v does not exist", autoFile)
+	}
+	existingVersion := declextract.DescriptionsVersion(existing)
+	if existingVersion == version {
+		return
+	}
+	logger.Warn(fmt.Sprintf("%v was generated with %q, current version is %q", autoFile, existingVersion, version),
+		"phase", "load")
+	if strict {
+		exit(1)
+	}
 }
 
-type compileCommand struct {
-	Command   string
-	Directory string
-	File      string
+func writeSubsystemParts(dir string, extractCfg *declextract.Config, res *declextract.Result) {
+	if err := osutil.MkdirAll(dir); err != nil {
+		failf("finish", "%v", err)
+	}
+	parts, err := declextract.SplitBySubsystem(extractCfg, res)
+	if err != nil {
+		failf("finish", "%v", err)
+	}
+	for subsys, part := range parts {
+		data, err := declextract.FormatDescriptions(part)
+		if err != nil {
+			failf("finish", "subsystem %v: %v", subsys, err)
+		}
+		if err := writeIfChanged(filepath.Join(dir, "auto_"+subsys+".txt"), data); err != nil {
+			failf("finish", "%v", err)
+		}
+	}
 }
 
-func loadCompileCommands(file string) ([]compileCommand, error) {
-	data, err := os.ReadFile(file)
+// writeIfChanged writes data to the file unless the file already has the same contents.
+// The file is replaced atomically, so that concurrent readers never see a partially written file.
+func writeIfChanged(file string, data []byte) error {
+	if existing, err := os.ReadFile(file); err == nil && bytes.Equal(existing, data) {
+		return nil
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp*")
 	if err != nil {
-		return nil, err
+		return err
 	}
-	var cmds []compileCommand
-	if err := json.Unmarshal(data, &cmds); err != nil {
-		return nil, err
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
 	}
-	// Remove commands that don't relate to the kernel build
-	// (probably some host tools, etc).
-	cmds = slices.DeleteFunc(cmds, func(cmd compileCommand) bool {
-		return !strings.HasSuffix(cmd.File, ".c") ||
-			// Files compiled with gcc are not a part of the kernel
-			// (assuming compile commands were generated with make CC=clang).
-			// They are probably a part of some host tool.
-			strings.HasPrefix(cmd.Command, "gcc") ||
-			// KBUILD should add this define all kernel files.
-			!strings.Contains(cmd.Command, "-DKBUILD_BASENAME")
-	})
-	// Shuffle the order to detect any non-determinism caused by the order early.
-	// The result should be the same regardless.
-	rand.New(rand.NewSource(time.Now().UnixNano())).Shuffle(len(cmds), func(i, j int) {
-		cmds[i], cmds[j] = cmds[j], cmds[i]
-	})
-	return cmds, nil
+	if err == nil {
+		err = os.Chmod(tmp.Name(), osutil.DefaultFilePerm)
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
 }
 
-type output struct {
-	file   string
-	output []byte
-	err    error
+// treeUnlock releases the lock taken by lockTree (nil if the lock is not held).
+var treeUnlock func()
+
+// lockTree serializes runs in the same tree (-concurrency-safe-temp): concurrent runs (e.g. CI jobs
+// sharing a checkout) would otherwise read descriptions the other run is writing, and overwrite each other's
+// results. The lock is taken before the existing descriptions are read (it's a no-op if already held),
+// and is held until unlockTree after the new descriptions are written (failf exits with the lock held,
+// it's released by the OS).
+func lockTree() {
+	if treeUnlock != nil {
+		return
+	}
+	dir := osutil.Abs(filepath.Dir(autoFile))
+	file := filepath.Join(os.TempDir(), "syz-declextract-"+hash.String([]byte(dir))+".lock")
+	unlock, err := osutil.LockFile(file)
+	if err != nil {
+		failf("load", "failed to lock %v: %v", file, err)
+	}
+	treeUnlock = unlock
 }
 
-type Interface struct {
-	Type               string
-	Name               string
-	Files              []string
-	Func               string
-	Access             string
-	Subsystems         []string
-	ManualDescriptions bool
-	AutoDescriptions   bool
+func unlockTree() {
+	if treeUnlock != nil {
+		treeUnlock()
+		treeUnlock = nil
+	}
+}
 
-	identifyingConst string
+func reportAmbiguous(file string, cfg *declextract.Config, strict bool) {
+	data, err := declextract.AmbiguousSyscalls(cfg)
+	if err != nil {
+		failf("load", "%v", err)
+	}
+	if file == "-" {
+		os.Stdout.Write(data)
+	} else if err := osutil.WriteFile(file, data); err != nil {
+		failf("load", "%v", err)
+	}
+	if strict && len(data) != 0 {
+		failf("load", "got %v ambiguous syscalls in strict mode", bytes.Count(data, []byte("\n")))
+	}
 }
 
-func (iface *Interface) ID() string {
-	return fmt.Sprintf("%v/%v", iface.Type, iface.Name)
+// checkDir fails if the dir does not exist.
+func checkDir(what, dir string) {
+	if !osutil.IsDir(dir) {
+		failf("load", "%v dir %v does not exist", what, dir)
+	}
 }
 
-func serializeInterfaces(ifaces []Interface) []byte {
-	w := new(bytes.Buffer)
-	for _, iface := range ifaces {
-		fmt.Fprintf(w, "%v\t%v\tfunc:%v\taccess:%v\tmanual_desc:%v\tauto_desc:%v",
-			iface.Type, iface.Name, iface.Func, iface.Access,
-			iface.ManualDescriptions, iface.AutoDescriptions)
-		for _, file := range iface.Files {
-			fmt.Fprintf(w, "\tfile:%v", file)
-		}
-		for _, subsys := range iface.Subsystems {
-			fmt.Fprintf(w, "\tsubsystem:%v", subsys)
-		}
-		fmt.Fprintf(w, "\n")
+// writeNewInterfaces writes interfaces that are not present in the existing info file.
+// It must be called before the info file is overwritten.
+func writeNewInterfaces(file string, interfaces []declextract.Interface) {
+	data, err := os.ReadFile(autoFile + ".info")
+	if err != nil {
+		failf("finish", "failed to read existing interfaces: %v", err)
+	}
+	prev, err := declextract.ParseInterfaces(data)
+	if err != nil {
+		failf("finish", "failed to parse %v.info: %v", autoFile, err)
+	}
+	added := declextract.SerializeInterfaces(declextract.NewInterfaces(prev, interfaces))
+	if file == "-" {
+		os.Stdout.Write(added)
+		return
+	}
+	if err := osutil.WriteFile(file, added); err != nil {
+		failf("finish", "%v", err)
 	}
-	return w.Bytes()
 }
 
-func (ctx *context) finishInterfaces() []Interface {
-	var interfaces []Interface
-	for _, iface := range ctx.interfaces {
-		slices.Sort(iface.Files)
-		iface.Files = slices.Compact(iface.Files)
-		var crashes []*subsystem.Crash
-		for _, file := range iface.Files {
-			crashes = append(crashes, &subsystem.Crash{GuiltyPath: file})
-		}
-		for _, s := range ctx.extractor.Extract(crashes) {
-			iface.Subsystems = append(iface.Subsystems, s.Name)
-		}
-		slices.Sort(iface.Subsystems)
-		if iface.Access == "" {
-			iface.Access = "unknown"
-		}
-		interfaces = append(interfaces, iface)
+// refreshSubsystems recomputes subsystems of interfaces in the existing info file and rewrites it.
+func refreshSubsystems(subsystems []*subsystem.Subsystem, primary bool, sortBy string, strict bool) {
+	file := autoFile + ".info"
+	data, err := os.ReadFile(file)
+	if err != nil {
+		failf("load", "failed to read existing interfaces: %v", err)
 	}
-	slices.SortFunc(interfaces, func(a, b Interface) int {
-		return strings.Compare(a.ID(), b.ID())
-	})
-	checkDescriptionPresence(interfaces, autoFile)
-	return interfaces
+	interfaces, err := declextract.ParseInterfaces(data)
+	if err != nil {
+		failf("load", "failed to parse %v: %v", file, err)
+	}
+	if warnings := declextract.RefreshSubsystems(interfaces, subsystems, primary, logger); strict && warnings != 0 {
+		failf("finish", "got %v warnings in strict mode", warnings)
+	}
+	if err := declextract.SortInterfaces(interfaces, sortBy); err != nil {
+		failf("finish", "%v", err)
+	}
+	if err := writeIfChanged(file, declextract.SerializeInterfaces(interfaces)); err != nil {
+		failf("finish", "%v", err)
+	}
+	logger.Info(fmt.Sprintf("refreshed subsystems of %v interfaces", len(interfaces)), "phase", "finish")
 }
 
-func (ctx *context) mergeInterface(iface Interface) {
-	prev, ok := ctx.interfaces[iface.ID()]
-	if ok {
-		if iface.identifyingConst != prev.identifyingConst {
-			tool.Failf("interface %v has different identifying consts: %v vs %v",
-				iface.ID(), iface.identifyingConst, prev.identifyingConst)
-		}
-		iface.Files = append(iface.Files, prev.Files...)
+// printStats logs stats of the descriptions along with stats of the existing descriptions.
+func printStats(desc *ast.Description) {
+	msg := fmt.Sprintf("descriptions have %v", declextract.GetDescriptionStats(desc))
+	if prev := readExisting(autoFile); prev != nil {
+		msg += fmt.Sprintf(" (was %v)", declextract.GetDescriptionStats(prev))
 	}
-	ctx.interfaces[iface.ID()] = iface
+	logger.Info(msg, "phase", "finish")
 }
 
-func checkDescriptionPresence(interfaces []Interface, autoFile string) {
-	desc := ast.ParseGlob(filepath.Join("sys", target.OS, "*.txt"), nil)
-	if desc == nil {
-		tool.Failf("failed to parse descriptions")
-	}
-	consts := compiler.ExtractConsts(desc, target, nil)
-	auto := make(map[string]bool)
-	manual := make(map[string]bool)
-	for file, desc := range consts {
-		for _, c := range desc.Consts {
-			if file == autoFile {
-				auto[c.Name] = true
-			} else {
-				manual[c.Name] = true
+// checkShrink fails if the number of nodes in the descriptions (not counting comments) dropped
+// by more than maxPercent percent compared to the existing descriptions.
+func checkShrink(desc *ast.Description, maxPercent int) {
+	prev := readExisting(autoFile)
+	if prev == nil {
+		return
+	}
+	count := func(desc *ast.Description) int {
+		n := 0
+		for _, node := range desc.Nodes {
+			switch node.(type) {
+			case *ast.Comment, *ast.NewLine:
+			default:
+				n++
 			}
 		}
+		return n
 	}
-	for i := range interfaces {
-		iface := &interfaces[i]
-		if auto[iface.identifyingConst] {
-			iface.AutoDescriptions = true
-		}
-		if manual[iface.identifyingConst] {
-			iface.ManualDescriptions = true
-		}
+	before, after := count(prev), count(desc)
+	if before == 0 || after >= before {
+		return
+	}
+	if shrink := (before - after) * 100 / before; shrink > maxPercent {
+		failf("finish", "descriptions shrank by %v%% (%v -> %v nodes), more than -max-shrink-percent=%v",
+			shrink, before, after, maxPercent)
 	}
 }
 
-func writeDescriptions(desc *ast.Description) {
-	// New lines are added in the parsing step. This is why we need to Format (serialize the description),
-	// Parse, then Format again.
-	output := ast.Format(ast.Parse(ast.Format(desc), "", ast.LoggingHandler))
-	if err := osutil.WriteFile(autoFile, output); err != nil {
-		tool.Fail(err)
+// readExisting returns the existing descriptions in the file, or nil if the file does not exist.
+func readExisting(file string) *ast.Description {
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		failf("finish", "%v", err)
+	}
+	desc := ast.Parse(data, file, errorHandler("finish"))
+	if desc == nil {
+		failf("finish", "failed to parse existing %v", file)
 	}
+	return desc
 }
 
-func (ctx *context) finishDescriptions() {
-	slices.SortFunc(ctx.nodes, func(a, b ast.Node) int {
-		return strings.Compare(ast.SerializeNode(a), ast.SerializeNode(b))
-	})
-	ctx.nodes = slices.CompactFunc(ctx.nodes, func(a, b ast.Node) bool {
-		return ast.SerializeNode(a) == ast.SerializeNode(b)
-	})
-	slices.SortStableFunc(ctx.nodes, func(a, b ast.Node) int {
-		return getTypeOrder(a) - getTypeOrder(b)
-	})
+func errorHandler(phase string) ast.ErrorHandler {
+	return func(pos ast.Pos, msg string) {
+		logger.Error(msg, "phase", phase, "pos", pos.String())
+	}
+}
 
-	prevCall, prevCallIndex := "", 0
-	for _, node := range ctx.nodes {
-		switch n := node.(type) {
-		case *ast.Call:
-			if n.Name.Name == prevCall {
-				n.Name.Name += strconv.Itoa(prevCallIndex)
-				prevCallIndex++
-			} else {
-				prevCall = n.Name.Name
-				prevCallIndex = 0
-			}
-		}
+var logger = slog.Default()
+
+func newLogger(level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
 	}
+	opts := &slog.HandlerOptions{Level: lvl}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// failf logs the error and exits.
+func failf(phase, msg string, args ...any) {
+	logger.Error(fmt.Sprintf(msg, args...), "phase", phase)
+	exit(1)
+}
+
+// stopProfiling writes the profiles requested with -cpuprofile/-memprofile (see tool.Init).
+var stopProfiling = func() {}
+
+// exit is os.Exit that does not lose the profiles and the metrics.
+func exit(code int) {
+	stopProfiling()
+	writeMetrics(code)
+	os.Exit(code)
+}
+
+// multiFlag is a flag that can be specified multiple times.
+type multiFlag []string
 
-	// These additional includes must be at the top (added after sorting), because other kernel headers
-	// are broken and won't compile without these additional ones included first.
-	header := `# Code generated by syz-declextract. DO NOT EDIT.
+func (f *multiFlag) String() string {
+	return strings.Join(*f, ",")
+}
 
-include <include/vdso/bits.h>
-include <include/linux/types.h>
-`
-	desc := ast.Parse([]byte(header), "", nil)
-	ctx.nodes = append(desc.Nodes, ctx.nodes...)
+func (f *multiFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
 
-func removeUnused(desc *ast.Description) {
-	all := ast.ParseGlob(filepath.Join("sys", target.OS, "*.txt"), nil)
-	if all == nil {
-		tool.Failf("failed to parse descriptions")
+func listFiles(cmds []declextract.CompileCommand, cfg *mgrconfig.Config) {
+	var files []string
+	for _, cmd := range cmds {
+		file, _ := declextract.RelativePath(cfg.KernelSrc, cfg.KernelObj, cmd.File)
+		files = append(files, file)
+	}
+	slices.Sort(files)
+	for _, file := range files {
+		fmt.Println(file)
 	}
-	unusedNodes, err := compiler.CollectUnused(all, target, nil)
+}
+
+// readFileList reads a list of files (one per line) and returns them as a set of clean absolute paths.
+// Relative paths are assumed to be relative to the kernel source dir.
+func readFileList(file, sourceDir string) (map[string]bool, error) {
+	data, err := os.ReadFile(file)
 	if err != nil {
-		tool.Failf("failed to typecheck descriptions: %v", err)
+		return nil, err
 	}
-	unused := make(map[string]bool)
-	for _, n := range unusedNodes {
-		if pos, typ, name := n.Info(); pos.File == autoFile {
-			unused[fmt.Sprintf("%v/%v", typ, name)] = true
+	files := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if !filepath.IsAbs(line) {
+			line = filepath.Join(sourceDir, line)
 		}
+		files[filepath.Clean(line)] = true
 	}
-	desc.Nodes = slices.DeleteFunc(desc.Nodes, func(n ast.Node) bool {
-		_, typ, name := n.Info()
-		return unused[fmt.Sprintf("%v/%v", typ, name)]
+	return files, nil
+}
+
+func sortTimings(timings []declextract.FileTiming) {
+	slices.SortFunc(timings, func(a, b declextract.FileTiming) int {
+		if a.Duration != b.Duration {
+			if a.Duration > b.Duration {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.File, b.File)
 	})
 }
 
-func (ctx *context) worker(outputs chan *output, files chan string, cache bool) {
-	for file := range files {
-		cacheFile := filepath.Join(ctx.cfg.Workdir, "declextract.cache",
-			strings.TrimPrefix(strings.TrimPrefix(filepath.Clean(file),
-				ctx.cfg.KernelSrc), ctx.cfg.KernelObj))
-		if cache {
-			out, err := os.ReadFile(cacheFile)
-			if err == nil {
-				outputs <- &output{file, out, nil}
-				continue
+func printTimings(timings []declextract.FileTiming, n int) {
+	sortTimings(timings)
+	var total time.Duration
+	for _, t := range timings {
+		total += t.Duration
+	}
+	fmt.Printf("slowest files:\n")
+	for _, t := range timings[:min(n, len(timings))] {
+		fmt.Printf("%8.2fs %v\n", t.Duration.Seconds(), t.File)
+	}
+	fmt.Printf("total: %.2fs for %v files\n", total.Seconds(), len(timings))
+}
+
+// serializeMetrics returns metrics of the run in the Prometheus text format, e.g.:
+//
+//	syz_declextract_files 123
+//
+// runMetrics are the state of the run written to -metrics-out by writeMetrics.
+var runMetrics struct {
+	file       string
+	start      time.Time
+	cacheDir   string
+	res        *declextract.Result // nil if extraction has not finished
+	toolErrors int
+}
+
+// writeMetrics writes the metrics once, with the exit code of the run.
+func writeMetrics(code int) {
+	if runMetrics.file == "" {
+		return
+	}
+	file := runMetrics.file
+	runMetrics.file = ""
+	failing := 0
+	if runMetrics.cacheDir != "" {
+		files, err := declextract.LoadFailingFiles(runMetrics.cacheDir)
+		if err != nil {
+			logger.Error(fmt.Sprintf("failed to load failing files: %v", err), "phase", "finish")
+		}
+		failing = len(files)
+	}
+	res := runMetrics.res
+	if res == nil {
+		res = new(declextract.Result)
+	}
+	data := serializeMetrics(res, failing, runMetrics.toolErrors, code, time.Since(runMetrics.start))
+	if err := osutil.WriteFile(file, data); err != nil {
+		logger.Error(fmt.Sprintf("failed to write metrics: %v", err), "phase", "finish")
+	}
+}
+
+func serializeMetrics(res *declextract.Result, failing, toolErrors, code int, duration time.Duration) []byte {
+	syscalls := 0
+	if res.Descriptions != nil {
+		for _, node := range res.Descriptions.Nodes {
+			if _, ok := node.(*ast.Call); ok {
+				syscalls++
 			}
 		}
-		// Suppress warning since we may build the tool on a different clang
-		// version that produces more warnings.
-		out, err := exec.Command(ctx.clangTool, "-p", ctx.compilationDatabase, file, "--extra-arg=-w").Output()
-		var exitErr *exec.ExitError
-		if err != nil && errors.As(err, &exitErr) && len(exitErr.Stderr) != 0 {
-			err = fmt.Errorf("%s", exitErr.Stderr)
+	}
+	var auto, manual, undescribed int
+	for _, iface := range res.Interfaces {
+		if iface.AutoDescriptions {
+			auto++
+		}
+		if iface.ManualDescriptions {
+			manual++
 		}
-		if err == nil {
-			osutil.MkdirAll(filepath.Dir(cacheFile))
-			osutil.WriteFile(cacheFile, out)
+		if !iface.AutoDescriptions && !iface.ManualDescriptions {
+			undescribed++
 		}
-		outputs <- &output{file, out, err}
 	}
+	w := new(bytes.Buffer)
+	for _, metric := range []struct {
+		name  string
+		value any
+	}{
+		{"files", len(res.Timings)},
+		{"failing_files", failing},
+		{"tool_errors", toolErrors},
+		{"warnings", res.Warnings},
+		{"syscalls", syscalls},
+		{"interfaces", len(res.Interfaces)},
+		{"interfaces_auto_descriptions", auto},
+		{"interfaces_manual_descriptions", manual},
+		{"interfaces_without_descriptions", undescribed},
+		{"duration_seconds", fmt.Sprintf("%.3f", duration.Seconds())},
+		{"exit_code", code},
+	} {
+		fmt.Fprintf(w, "syz_declextract_%v %v\n", metric.name, metric.value)
+	}
+	return w.Bytes()
 }
 
-func (ctx *context) renameSyscall(syscall *ast.Call) []ast.Node {
-	names := ctx.syscallNameMap[syscall.CallName]
-	if len(names) == 0 {
-		// Syscall has no record in the tables for the architectures we support.
-		return nil
-	}
-	variant := strings.TrimPrefix(syscall.Name.Name, syscall.CallName)
-	if variant == "" {
-		variant = "$auto"
-	}
-	var renamed []ast.Node
-	for _, name := range names {
-		newCall := syscall.Clone().(*ast.Call)
-		newCall.Name.Name = name + variant
-		newCall.CallName = name // Not required	but avoids mistakenly treating CallName as the part before the $.
-		renamed = append(renamed, newCall)
-	}
-
-	return renamed
-}
-
-func readSyscallMap(sourceDir string) map[string][]string {
-	// Parse arch/*/*.tbl files that map functions defined with SYSCALL_DEFINE macros to actual syscall names.
-	// Lines in the files look as follows:
-	//	288      common  accept4                 sys_accept4
-	// Total mapping is many-to-many, so we give preference to x86 arch, then to 64-bit syscalls,
-	// and then just order arches by name to have deterministic result.
-	type desc struct {
-		fn      string
-		arch    string
-		is64bit bool
-	}
-	syscalls := make(map[string][]desc)
-	for _, arch := range targets.List[target.OS] {
-		filepath.Walk(filepath.Join(sourceDir, "arch", arch.KernelHeaderArch),
-			func(path string, info fs.FileInfo, err error) error {
-				if err != nil || !strings.HasSuffix(path, ".tbl") {
-					return err
-				}
-				f, err := os.Open(path)
-				if err != nil {
-					tool.Fail(err)
-				}
-				defer f.Close()
-				for s := bufio.NewScanner(f); s.Scan(); {
-					fields := strings.Fields(s.Text())
-					if len(fields) < 4 || fields[0] == "#" {
-						continue
-					}
-					group := fields[1]
-					syscall := fields[2]
-					fn := strings.TrimPrefix(fields[3], "sys_")
-					if strings.HasPrefix(syscall, "unused") || fn == "-" ||
-						// Powerpc spu group defines some syscalls (utimesat)
-						// that are not present on any of our arches.
-						group == "spu" ||
-						// llseek does not exist, it comes from:
-						//	arch/arm64/tools/syscall_64.tbl -> scripts/syscall.tbl
-						//	62  32      llseek                          sys_llseek
-						// So scripts/syscall.tbl is pulled for 64-bit arch, but the syscall
-						// is defined only for 32-bit arch in that file.
-						syscall == "llseek" ||
-						// Don't want to test it (see issue 5308).
-						syscall == "reboot" {
-						continue
-					}
-					syscalls[syscall] = append(syscalls[syscall], desc{
-						fn:      fn,
-						arch:    arch.VMArch,
-						is64bit: group == "common" || strings.Contains(group, "64"),
-					})
-				}
-				return nil
-			})
-	}
-
-	rename := map[string][]string{
-		"syz_genetlink_get_family_id": {"syz_genetlink_get_family_id"},
-	}
-	for syscall, descs := range syscalls {
-		slices.SortFunc(descs, func(a, b desc) int {
-			if (a.arch == target.Arch) != (b.arch == target.Arch) {
-				if a.arch == target.Arch {
-					return -1
-				}
-				return 1
-			}
-			if a.is64bit != b.is64bit {
-				if a.is64bit {
-					return -1
-				}
-				return 1
-			}
-			return strings.Compare(a.arch, b.arch)
-		})
-		fn := descs[0].fn
-		rename[fn] = append(rename[fn], syscall)
-	}
-	return rename
-}
-
-func (ctx *context) appendNodes(nodes []ast.Node, file string) {
-	for _, node := range nodes {
-		switch node := node.(type) {
-		case *ast.Call:
-			// Some syscalls have different names and entry points and thus need to be renamed.
-			// e.g. SYSCALL_DEFINE1(setuid16, old_uid_t, uid) is referred to in the .tbl file with setuid.
-			ctx.nodes = append(ctx.nodes, ctx.renameSyscall(node)...)
-		case *ast.Include:
-			if file, err := filepath.Rel(ctx.cfg.KernelSrc, filepath.Join(ctx.cfg.KernelObj, node.File.Value)); err == nil {
-				node.File.Value = file
-			}
-			if replace := includeReplaces[node.File.Value]; replace != "" {
-				node.File.Value = replace
-			}
-			ctx.nodes = append(ctx.nodes, node)
-		case *ast.Comment:
-			switch {
-			case strings.HasPrefix(node.Text, "INTERFACE:"):
-				fields := strings.Fields(node.Text)
-				if len(fields) != 6 {
-					tool.Failf("%q has wrong number of fields", node.Text)
-				}
-				for i := range fields {
-					if fields[i] == "-" {
-						fields[i] = ""
-					}
-				}
-				iface := Interface{
-					Type:             fields[1],
-					Name:             fields[2],
-					Files:            []string{file},
-					identifyingConst: fields[3],
-					Func:             fields[4],
-					Access:           fields[5],
-				}
-				if iface.Type == "SYSCALL" {
-					for _, name := range ctx.syscallNameMap[iface.Name] {
-						iface.Name = name
-						iface.identifyingConst = "__NR_" + name
-						ctx.mergeInterface(iface)
-					}
-				} else {
-					ctx.mergeInterface(iface)
-				}
-			default:
-				ctx.nodes = append(ctx.nodes, node)
-			}
-		default:
-			ctx.nodes = append(ctx.nodes, node)
-		}
-	}
-}
-
-// Replace these includes in the tool output.
-var includeReplaces = map[string]string{
-	// Arches may use some includes from asm-generic and some from arch/arm.
-	// If the arch used for extract used asm-generic for a header,
-	// other arches may need arch/asm version of the header. So switch to
-	// a more generic file name that should resolve correctly for all arches.
-	"include/uapi/asm-generic/ioctls.h":  "asm/ioctls.h",
-	"include/uapi/asm-generic/sockios.h": "asm/sockios.h",
-}
-
-func getTypeOrder(a ast.Node) int {
-	switch a.(type) {
-	case *ast.Comment:
-		return 0
-	case *ast.Include:
-		return 1
-	case *ast.Define:
-		return 2
-	case *ast.IntFlags:
-		return 3
-	case *ast.Resource:
-		return 4
-	case *ast.TypeDef:
-		return 5
-	case *ast.Call:
-		return 6
-	case *ast.Struct:
-		return 7
-	case *ast.NewLine:
-		return 8
-	default:
-		panic(fmt.Sprintf("unhandled type %T", a))
+// serializeTimings returns extraction times for all files, slowest first.
+// Lines look as follows:
+//
+//	12.345	fs/read_write.c
+func serializeTimings(timings []declextract.FileTiming) []byte {
+	sortTimings(timings)
+	w := new(bytes.Buffer)
+	for _, t := range timings {
+		fmt.Fprintf(w, "%.3f\t%v\n", t.Duration.Seconds(), t.File)
 	}
+	return w.Bytes()
 }
@@ -586,9 +586,14 @@ std::map<int, EnumData> extractDesignatedInitConsts(ASTContext &context, const V
 
 class SyscallMatcher : public MatchFinder::MatchCallback {
 public:
-  SyscallMatcher(MatchFinder &Finder) {
+  SyscallMatcher(MatchFinder &Finder, bool Compat) {
     Finder.addMatcher(functionDecl(isExpandedFromMacro("SYSCALL_DEFINEx"), matchesName("__do_sys_.*")).bind("syscall"),
                       this);
+    if (Compat) {
+      Finder.addMatcher(functionDecl(isExpandedFromMacro("COMPAT_SYSCALL_DEFINEx"), matchesName("__do_compat_sys_.*"))
+                            .bind("compat_syscall"),
+                        this);
+    }
   }
 
 private:
@@ -598,9 +603,17 @@ private:
     RecordExtractor recordExtractor(Result.SourceManager);
 
     const char *sep = "";
-    const auto func = syscall->getNameAsString();
-    const auto &name = func.substr(9); // Remove "__do_sys_" prefix.
-    emitInterface("SYSCALL", name, "__NR_" + name, func);
+    std::string name;
+    if (syscall) {
+      const auto func = syscall->getNameAsString();
+      name = func.substr(9); // Remove "__do_sys_" prefix.
+      emitInterface("SYSCALL", name, "__NR_" + name, func);
+    } else {
+      // Compat syscalls are emitted with "compat_" prefix, the Go part maps them to the native syscall names.
+      // They don't have own interfaces since the native syscall interface covers them.
+      syscall = Result.Nodes.getNodeAs<FunctionDecl>("compat_syscall");
+      name = "compat_" + syscall->getNameAsString().substr(16); // Remove "__do_compat_sys_" prefix.
+    }
     printf("%s(", name.c_str());
     for (const auto &param : syscall->parameters()) {
       const auto &type = recordExtractor.getFieldType(param->getType(), context, param->getNameAsString(), "", true);
@@ -997,8 +1010,11 @@ private:
   }
 };
 
+static llvm::cl::OptionCategory SyzDeclExtractOptionCategory("syz-declextract options");
+static llvm::cl::opt<bool> Compat("compat", llvm::cl::desc("Also extract compat syscalls (COMPAT_SYSCALL_DEFINEx)"),
+                                  llvm::cl::cat(SyzDeclExtractOptionCategory));
+
 int main(int argc, const char **argv) {
-  llvm::cl::OptionCategory SyzDeclExtractOptionCategory("syz-declextract options");
   auto ExpectedParser = clang::tooling::CommonOptionsParser::create(argc, argv, SyzDeclExtractOptionCategory);
   if (!ExpectedParser) {
     llvm::errs() << ExpectedParser.takeError();
@@ -1006,7 +1022,7 @@ int main(int argc, const char **argv) {
   }
 
   MatchFinder Finder;
-  SyscallMatcher SyscallMatcher(Finder);
+  SyscallMatcher SyscallMatcher(Finder, Compat);
   NetlinkPolicyMatcher NetlinkPolicyMatcher(Finder);
   IouringMatcher IouringMatcher(Finder);
 